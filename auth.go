@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Auth 任务凭据, 只发送给 Host
+type Auth struct {
+	Host     string
+	User     string
+	Password string
+	Bearer   string
+
+	mu     sync.Mutex
+	digest map[string]string // 最近一次 Digest 质询
+	nc     int
+}
+
+// ParseUserPass 解析 "user:pass"
+func ParseUserPass(s string) (user, pass string) {
+	user, pass, _ = strings.Cut(s, ":")
+	return
+}
+
+// Apply 为请求设置 Authorization, 主机不符时跳过
+func (a *Auth) Apply(req *http.Request) {
+	if a == nil || !strings.EqualFold(req.URL.Host, a.Host) {
+		return
+	}
+	switch {
+	case a.Bearer != "":
+		req.Header.Set("Authorization", "Bearer "+a.Bearer)
+	case a.User != "":
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.digest != nil {
+			req.Header.Set("Authorization", a.digestAuthorization(req))
+		} else {
+			req.SetBasicAuth(a.User, a.Password)
+		}
+	}
+}
+
+// Challenge 处理 401 质询, 返回是否值得带上新凭据重试
+func (a *Auth) Challenge(resp *http.Response) bool {
+	if a == nil || a.User == "" || !strings.EqualFold(resp.Request.URL.Host, a.Host) {
+		return false
+	}
+	sent := resp.Request.Header.Get("Authorization") != ""
+	for _, v := range resp.Header.Values("WWW-Authenticate") {
+		scheme, params, _ := strings.Cut(v, " ")
+		if strings.EqualFold(scheme, "Basic") && !sent {
+			return true
+		}
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		c := parseAuthParams(params)
+		a.mu.Lock()
+		retry := a.digest == nil || strings.EqualFold(c["stale"], "true")
+		if retry {
+			a.digest = c
+			a.nc = 0
+		}
+		a.mu.Unlock()
+		return retry
+	}
+	return false
+}
+
+// digestAuthorization RFC 7616, 支持 MD5, SHA-256 及其 -sess
+func (a *Auth) digestAuthorization(req *http.Request) string {
+	c := a.digest
+	algo := c["algorithm"]
+	var newHash func() hash.Hash
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algo), "-sess")) {
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		newHash = md5.New
+	}
+	h := func(s string) string {
+		hh := newHash()
+		hh.Write([]byte(s))
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+
+	a.nc++
+	nc := fmt.Sprintf("%08x", a.nc)
+	cnonce := make([]byte, 8)
+	rand.Read(cnonce)
+	cn := hex.EncodeToString(cnonce)
+	uri := req.URL.RequestURI()
+
+	ha1 := h(a.User + ":" + c["realm"] + ":" + a.Password)
+	if strings.HasSuffix(strings.ToLower(algo), "-sess") {
+		ha1 = h(ha1 + ":" + c["nonce"] + ":" + cn)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	var qop string
+	for _, q := range strings.Split(c["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	var response string
+	if qop != "" {
+		response = h(strings.Join([]string{ha1, c["nonce"], nc, cn, qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + c["nonce"] + ":" + ha2)
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		a.User, c["realm"], c["nonce"], uri, response)
+	if algo != "" {
+		fmt.Fprintf(b, ", algorithm=%s", algo)
+	}
+	if qop != "" {
+		fmt.Fprintf(b, `, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cn)
+	}
+	if c["opaque"] != "" {
+		fmt.Fprintf(b, `, opaque="%s"`, c["opaque"])
+	}
+	return b.String()
+}
+
+// parseAuthParams 解析 k=v, k="v, w" 形式的参数
+func parseAuthParams(s string) map[string]string {
+	m := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, ", ") {
+		k, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				v, s = rest[1:], ""
+			} else {
+				v, s = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			v, s, _ = strings.Cut(rest, ",")
+			v = strings.TrimSpace(v)
+		}
+		m[k] = v
+	}
+	return m
+}
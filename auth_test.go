@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	m := parseAuthParams(`realm="a, b", qop="auth,auth-int", nonce=xyz, stale=true`)
+	for k, want := range map[string]string{
+		"realm": "a, b",
+		"qop":   "auth,auth-int",
+		"nonce": "xyz",
+		"stale": "true",
+	} {
+		if m[k] != want {
+			t.Errorf("%s = %q, want %q", k, m[k], want)
+		}
+	}
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestServer 需要 Digest 认证的服务器
+func digestServer(t *testing.T, user, pass string) *httptest.Server {
+	const realm, nonce = "godown", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if scheme != "Digest" {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="5ccc"`, realm, nonce))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p := parseAuthParams(params)
+		ha1 := md5hex(user + ":" + realm + ":" + pass)
+		ha2 := md5hex(r.Method + ":" + p["uri"])
+		want := md5hex(strings.Join([]string{ha1, nonce, p["nc"], p["cnonce"], p["qop"], ha2}, ":"))
+		if p["response"] != want || p["opaque"] != "5ccc" || p["uri"] != r.URL.RequestURI() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDigestAuth(t *testing.T) {
+	srv := digestServer(t, "Mufasa", "Circle of Life")
+	u, _ := url.Parse(srv.URL)
+	j := &Job{Auth: &Auth{Host: u.Host, User: "Mufasa", Password: "Circle of Life"}}
+
+	for i := 0; i < 2; i++ { // 第二次直接使用缓存的质询
+		req, _ := j.newRequest(context.Background(), "GET", srv.URL+"/dir/index.html?x=1")
+		resp, err := j.do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("attempt %d: %s", i, resp.Status)
+		}
+	}
+
+	j.Auth = &Auth{Host: u.Host, User: "Mufasa", Password: "wrong"}
+	req, _ := j.newRequest(context.Background(), "GET", srv.URL)
+	resp, err := j.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("wrong password should fail")
+	}
+}
+
+func TestAuthHostScope(t *testing.T) {
+	a := &Auth{Host: "example.com", User: "u", Password: "p"}
+
+	req, _ := http.NewRequest("GET", "https://example.com/a", nil)
+	a.Apply(req)
+	if u, p, ok := req.BasicAuth(); !ok || u != "u" || p != "p" {
+		t.Fatal("basic auth not applied")
+	}
+
+	req, _ = http.NewRequest("GET", "https://cdn.example.net/a", nil)
+	a.Apply(req)
+	if req.Header.Get("Authorization") != "" {
+		t.Fatal("credentials sent to another host")
+	}
+
+	a = &Auth{Host: "example.com", Bearer: "token"}
+	req, _ = http.NewRequest("GET", "https://example.com/a", nil)
+	a.Apply(req)
+	if req.Header.Get("Authorization") != "Bearer token" {
+		t.Fatal("bearer not applied")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var ErrBencode = errors.New("invalid bencode")
+
+// bdecoder 整数为 int64, 字符串为 string, 列表为 []any, 字典为 map[string]any
+type bdecoder struct {
+	data []byte
+	pos  int
+	info []byte // 顶层字典中 info 的原始字节, 用于计算 info hash
+}
+
+// bdecode 解析完整的 bencode 数据
+func bdecode(data []byte) (any, error) {
+	v, n, err := bdecodePrefix(data)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("%w: trailing data at %d", ErrBencode, n)
+	}
+	return v, nil
+}
+
+// bdecodePrefix 解析开头的一个值, 返回其长度, ut_metadata 消息在字典后附带数据
+func bdecodePrefix(data []byte) (any, int, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value(0)
+	return v, d.pos, err
+}
+
+func (d *bdecoder) value(depth int) (any, error) {
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrBencode)
+	}
+	if depth > 64 {
+		return nil, fmt.Errorf("%w: nested too deep", ErrBencode)
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated integer", ErrBencode)
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBencode, err)
+		}
+		d.pos += end + 1
+		return n, nil
+
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(d.data[d.pos:], ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("%w: missing string length", ErrBencode)
+		}
+		n, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+		start := d.pos + colon + 1
+		if err != nil || n < 0 || n > len(d.data)-start {
+			return nil, fmt.Errorf("%w: bad string length at %d", ErrBencode, d.pos)
+		}
+		d.pos = start + n
+		return string(d.data[start:d.pos]), nil
+
+	case c == 'l':
+		d.pos++
+		list := []any{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		if d.pos >= len(d.data) {
+			return nil, fmt.Errorf("%w: unterminated list", ErrBencode)
+		}
+		d.pos++
+		return list, nil
+
+	case c == 'd':
+		d.pos++
+		dict := map[string]any{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: dictionary key is not a string", ErrBencode)
+			}
+			start := d.pos
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if depth == 0 && key == "info" {
+				d.info = d.data[start:d.pos]
+			}
+			dict[key] = v
+		}
+		if d.pos >= len(d.data) {
+			return nil, fmt.Errorf("%w: unterminated dictionary", ErrBencode)
+		}
+		d.pos++
+		return dict, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected %q at %d", ErrBencode, d.data[d.pos], d.pos)
+}
+
+// bencode 编码, 字典按键排序
+func bencode(v any) []byte {
+	b := &bytes.Buffer{}
+	bencodeTo(b, v)
+	return b.Bytes()
+}
+
+func bencodeTo(b *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(b, "i%de", v)
+	case int64:
+		fmt.Fprintf(b, "i%de", v)
+	case string:
+		fmt.Fprintf(b, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(b, "%d:", len(v))
+		b.Write(v)
+	case []any:
+		b.WriteByte('l')
+		for _, e := range v {
+			bencodeTo(b, e)
+		}
+		b.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('d')
+		for _, k := range keys {
+			bencodeTo(b, k)
+			bencodeTo(b, v[k])
+		}
+		b.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// bdict 字典取值的辅助函数, 类型不符时返回零值
+type bdict map[string]any
+
+func (d bdict) str(key string) string {
+	s, _ := d[key].(string)
+	return s
+}
+
+func (d bdict) int(key string) int {
+	n, _ := d[key].(int64)
+	return int(n)
+}
+
+func (d bdict) list(key string) []any {
+	l, _ := d[key].([]any)
+	return l
+}
+
+func (d bdict) dict(key string) bdict {
+	m, _ := d[key].(map[string]any)
+	return m
+}
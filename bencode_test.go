@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBencode(t *testing.T) {
+	v := map[string]any{
+		"announce": "http://tracker/announce",
+		"info": map[string]any{
+			"name":   "a.bin",
+			"length": 3,
+			"pieces": []byte{0, 1, 2},
+		},
+		"list": []any{"x", -7},
+	}
+	data := bencode(v)
+	want := "d8:announce23:http://tracker/announce4:infod6:lengthi3e4:name5:a.bin6:pieces3:\x00\x01\x02e4:listl1:xi-7eee"
+	if string(data) != want {
+		t.Fatalf("encode: %q", data)
+	}
+
+	d := &bdecoder{data: data}
+	got, err := d.value(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]any{
+		"announce": "http://tracker/announce",
+		"info":     map[string]any{"name": "a.bin", "length": int64(3), "pieces": "\x00\x01\x02"},
+		"list":     []any{"x", int64(-7)},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("decode: %#v", got)
+	}
+	if string(d.info) != "d6:lengthi3e4:name5:a.bin6:pieces3:\x00\x01\x02e" {
+		t.Fatalf("info: %q", d.info)
+	}
+
+	if _, n, err := bdecodePrefix([]byte("d1:ai1eeTRAILING")); err != nil || n != 8 {
+		t.Fatalf("prefix: %d, %v", n, err)
+	}
+	for _, s := range []string{"", "i12", "ixe", "5:abc", "l1:a", "di1ei2ee", "d1:ai1eeX", "x"} {
+		if _, err := bdecode([]byte(s)); !errors.Is(err, ErrBencode) {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Checksum 期望的文件校验值
+type Checksum struct {
+	Algo string
+	Sum  []byte
+}
+
+func (c Checksum) String() string {
+	return c.Algo + ":" + hex.EncodeToString(c.Sum)
+}
+
+// ParseChecksum 解析 "algo:hex" 或 "algo=hex"
+func ParseChecksum(s string) (*Checksum, error) {
+	algo, sum, ok := strings.Cut(s, ":")
+	if !ok {
+		algo, sum, ok = strings.Cut(s, "=")
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid checksum %q, want algo:hex", s)
+	}
+	algo = strings.ToLower(strings.TrimSpace(algo))
+	h := newHash(algo)
+	if h == nil {
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(sum))
+	if err != nil {
+		return nil, fmt.Errorf("invalid checksum %q: %v", s, err)
+	}
+	if len(b) != h.Size() {
+		return nil, fmt.Errorf("invalid %s checksum length: %d", algo, len(b))
+	}
+	return &Checksum{Algo: algo, Sum: b}, nil
+}
+
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// HashFile 计算文件校验值
+func HashFile(path, algo string) ([]byte, error) {
+	h := newHash(algo)
+	if h == nil {
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Verify 校验文件
+func (c *Checksum) Verify(path string) error {
+	sum, err := HashFile(path, c.Algo)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, c.Sum) {
+		return fmt.Errorf("%s mismatch: expected %x, got %x", c.Algo, c.Sum, sum)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	c, err := ParseChecksum("SHA256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Algo != "sha256" {
+		t.Fatalf("algo: %s", c.Algo)
+	}
+	if _, err = ParseChecksum("md5=5d41402abc4b2a76b9719d911017c592"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"", "sha256", "crc64:00", "md5:zz", "md5:00"} {
+		if _, err = ParseChecksum(s); err == nil {
+			t.Errorf("ParseChecksum(%q) should fail", s)
+		}
+	}
+}
+
+func TestChecksumVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := ParseChecksum("sha1:aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d")
+	if err := c.Verify(path); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = ParseChecksum("sha1:0000000000000000000000000000000000000000")
+	if err := c.Verify(path); err == nil {
+		t.Fatal("Verify should fail")
+	}
+}
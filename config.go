@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configKeys 配置文件与 GODOWN_* 环境变量的键 -> 参数名
+var configKeys = map[string]string{
+	"dir":            "d",
+	"tmp":            "tmp",
+	"min_free":       "min-free",
+	"threads":        "t",
+	"block_size":     "bs",
+	"jobs":           "jobs",
+	"proxy":          "p",
+	"http_proxy":     "http-proxy",
+	"https_proxy":    "https-proxy",
+	"mega_proxy":     "mega-proxy",
+	"no_proxy":       "no-proxy",
+	"http":           "http",
+	"dial_timeout":   "dial-timeout",
+	"tls_timeout":    "tls-timeout",
+	"header_timeout": "header-timeout",
+	"idle_timeout":   "idle-timeout",
+	"stall_timeout":  "stall-timeout",
+	"max_redirs":     "max-redirs",
+	"user_agent":     "user-agent",
+	"referer":        "referer",
+	"user":           "user",
+	"bearer":         "bearer",
+	"netrc_file":     "netrc-file",
+	"cookies":        "cookies",
+	"ca_cert":        "ca-cert",
+	"client_cert":    "client-cert",
+	"client_key":     "client-key",
+	"insecure":       "insecure",
+	"tls_min":        "tls-min",
+	"xattr":          "xattr",
+	"progress":       "progress",
+	"log_level":      "ll",
+	"log_file":       "log-file",
+	"log_format":     "log-format",
+	"profiles_file":  "profiles-file",
+}
+
+// Config 解析后的配置文件, 键为 configKeys 中的名字
+type Config struct {
+	Global  map[string]string
+	Headers []string
+	Hosts   map[string]*Config // 主机名或 *.域名
+
+	cli headerFlags // 命令行 -H, 不被主机段的头覆盖
+}
+
+var hostConfig *Config // 已加载的配置, 主机段的头按请求的主机添加
+
+// defaultConfigFile $XDG_CONFIG_HOME/godown/config.toml, 默认 ~/.config
+func defaultConfigFile() string {
+	if f := os.Getenv("GODOWN_CONFIG"); f != "" {
+		return f
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "godown", "config.toml")
+}
+
+// LoadConfig 读取配置文件, 文件不存在且 optional 时返回空配置
+func LoadConfig(file string, optional bool) (*Config, error) {
+	var raw map[string]any
+	if _, err := toml.DecodeFile(file, &raw); err != nil {
+		if optional && errors.Is(err, fs.ErrNotExist) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+	return parseConfig(raw, true)
+}
+
+func parseConfig(raw map[string]any, top bool) (*Config, error) {
+	c := &Config{Global: map[string]string{}}
+	for k, v := range raw {
+		switch {
+		case k == "headers":
+			list, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("headers: want an array of \"Name: value\" strings")
+			}
+			for _, h := range list {
+				s, ok := h.(string)
+				if !ok || !strings.Contains(s, ":") {
+					return nil, fmt.Errorf("headers: invalid header %v", h)
+				}
+				c.Headers = append(c.Headers, s)
+			}
+		case k == "hosts" && top:
+			hosts, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("hosts: want [hosts.\"example.com\"] tables")
+			}
+			c.Hosts = map[string]*Config{}
+			for host, section := range hosts {
+				m, ok := section.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("hosts.%s: want a table", host)
+				}
+				hc, err := parseConfig(m, false)
+				if err != nil {
+					return nil, fmt.Errorf("hosts.%s: %w", host, err)
+				}
+				c.Hosts[strings.ToLower(host)] = hc
+			}
+		default:
+			if _, ok := configKeys[k]; !ok {
+				return nil, fmt.Errorf("unknown key %q", k)
+			}
+			switch v.(type) {
+			case string, int64, float64, bool:
+				c.Global[k] = fmt.Sprint(v)
+			default:
+				return nil, fmt.Errorf("%s: unsupported value %v", k, v)
+			}
+		}
+	}
+	return c, nil
+}
+
+// sections 匹配主机的段, 从宽到窄: *.域名按长度, 最后是精确匹配
+func (c *Config) sections(host string) []*Config {
+	host = strings.ToLower(host)
+	var patterns []string
+	for pattern := range c.Hosts {
+		if ok, _ := path.Match(pattern, host); ok && strings.HasPrefix(pattern, "*.") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	slices.SortFunc(patterns, func(a, b string) int { return len(a) - len(b) })
+	var res []*Config
+	for _, pattern := range patterns {
+		res = append(res, c.Hosts[pattern])
+	}
+	if hc, ok := c.Hosts[host]; ok {
+		res = append(res, hc)
+	}
+	return res
+}
+
+// Apply 给命令行未设置的参数赋值, 优先级 CLI > GODOWN_* > 主机段 > 全局,
+// 全局的头按名字合并, 命令行 -H 给出的头不被覆盖; 主机段的头见 hostHeader
+func (c *Config) Apply(fs *flag.FlagSet, host string, headers *headerFlags) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	layers := append([]*Config{c}, c.sections(host)...)
+	keys := make([]string, 0, len(configKeys))
+	for k := range configKeys {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		name := configKeys[k]
+		if set[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		from := "GODOWN_" + strings.ToUpper(k)
+		value := os.Getenv(from)
+		for i := len(layers) - 1; i >= 0 && value == ""; i-- {
+			if v, ok := layers[i].Global[k]; ok {
+				value, from = v, k
+				if i > 0 {
+					from = "hosts." + host + "." + k
+				}
+			}
+		}
+		if value == "" {
+			continue
+		}
+		if k == "dir" || k == "tmp" || strings.HasSuffix(k, "_file") || strings.HasSuffix(k, "_cert") || strings.HasSuffix(k, "_key") {
+			value = expandHome(value)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %w", from, err)
+		}
+	}
+
+	c.cli = slices.Clone(*headers)
+	*headers = append(mergeHeaders([]*Config{c}, *headers), *headers...)
+	return nil
+}
+
+// mergeHeaders 合并各层的头, 窄的层覆盖宽的层中的同名头, skip 中出现的名字不合并
+func mergeHeaders(layers []*Config, skip headerFlags) headerFlags {
+	byName := map[string][]string{}
+	var order []string
+	for _, layer := range layers {
+		seen := map[string]bool{}
+		for _, h := range layer.Headers {
+			k, _, _ := strings.Cut(h, ":")
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if !seen[k] {
+				if _, ok := byName[k]; !ok {
+					order = append(order, k)
+				}
+				byName[k], seen[k] = nil, true
+			}
+			byName[k] = append(byName[k], h)
+		}
+	}
+	for _, h := range skip {
+		k, _, _ := strings.Cut(h, ":")
+		delete(byName, http.CanonicalHeaderKey(strings.TrimSpace(k)))
+	}
+	var merged headerFlags
+	for _, k := range order {
+		merged = append(merged, byName[k]...)
+	}
+	return merged
+}
+
+// hostHeader 主机段中给出的头, 只发送给匹配的主机
+func (c *Config) hostHeader(host string) headerFlags {
+	if c == nil {
+		return nil
+	}
+	return mergeHeaders(c.sections(host), c.cli)
+}
+
+// rehost 跨主机重定向时换掉上一主机段的头, 原本有的恢复为 base 中的值
+func (c *Config) rehost(req *http.Request, from string, base http.Header) {
+	for _, h := range c.hostHeader(from) {
+		k, _, _ := strings.Cut(h, ":")
+		k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+		if v, ok := base[k]; ok {
+			req.Header[k] = slices.Clone(v)
+		} else {
+			req.Header.Del(k)
+		}
+	}
+}
+
+func expandHome(p string) string {
+	if rest, ok := strings.CutPrefix(p, "~"); ok && (rest == "" || rest[0] == '/' || rest[0] == filepath.Separator) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return p
+}
+
+// sizeFlag 字节数, 可带 K/M/G 后缀 (1024 进制), 如 16MiB
+type sizeFlag int
+
+func (s *sizeFlag) String() string { return strconv.Itoa(int(*s)) }
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(n)
+	return nil
+}
+
+// zeroSizeFlag 同 sizeFlag, 另外接受 0 表示关闭, 如 -min-free
+type zeroSizeFlag sizeFlag
+
+func (s *zeroSizeFlag) String() string { return (*sizeFlag)(s).String() }
+func (s *zeroSizeFlag) Set(v string) error {
+	if strings.TrimSpace(v) == "0" {
+		*s = 0
+		return nil
+	}
+	return (*sizeFlag)(s).Set(v)
+}
+
+func parseSize(v string) (int, error) {
+	s := strings.TrimSpace(v)
+	num := strings.TrimRightFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	unit := strings.ToUpper(strings.TrimSpace(s[len(num):]))
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	switch strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I") {
+	case "":
+	case "K":
+		n <<= 10
+	case "M":
+		n <<= 20
+	case "G":
+		n <<= 30
+	default:
+		return 0, fmt.Errorf("invalid size unit %q", v)
+	}
+	return n, nil
+}
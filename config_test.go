@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const testConfig = `
+threads = 6
+block_size = "8MiB"
+proxy = "http://global:8080"
+user_agent = "godown-global"
+dir = "~/Downloads"
+headers = ["X-Team: infra", "Accept-Language: en"]
+
+[hosts."cdn.example.com"]
+threads = 16
+user = "alice:s3cret"
+headers = ["x-team: cdn"]
+
+[hosts."*.example.com"]
+threads = 2
+block_size = "1M"
+
+[hosts."*.files.example.com"]
+threads = 3
+`
+
+func TestConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(file, []byte(testConfig), 0644)
+	cfg, err := LoadConfig(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parse := func(host string, args ...string) (*flag.FlagSet, headerFlags) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Int("t", 6, "")
+		bs := sizeFlag(16 << 20)
+		fs.Var(&bs, "bs", "")
+		for _, name := range []string{"p", "d", "user", "user-agent"} {
+			fs.String(name, "", "")
+		}
+		var headers headerFlags
+		fs.Var(&headers, "H", "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.Apply(fs, host, &headers); err != nil {
+			t.Fatal(err)
+		}
+		return fs, headers
+	}
+	get := func(fs *flag.FlagSet, name string) string { return fs.Lookup(name).Value.String() }
+
+	t.Setenv("GODOWN_PROXY", "socks5://env:1080")
+	fs, headers := parse("CDN.example.com", "-t", "4", "-H", "Accept-Language: zh")
+	if get(fs, "t") != "4" || get(fs, "p") != "socks5://env:1080" || get(fs, "user") != "alice:s3cret" ||
+		get(fs, "bs") != "1048576" || get(fs, "user-agent") != "godown-global" {
+		t.Fatalf("cdn: t=%s p=%s user=%s bs=%s", get(fs, "t"), get(fs, "p"), get(fs, "user"), get(fs, "bs"))
+	}
+	if !slices.Equal(headers, headerFlags{"X-Team: infra", "Accept-Language: zh"}) {
+		t.Fatalf("headers: %v", headers)
+	}
+	if h := cfg.hostHeader("cdn.example.com"); !slices.Equal(h, headerFlags{"x-team: cdn"}) {
+		t.Fatalf("host headers: %v", h)
+	}
+	home, _ := os.UserHomeDir()
+	if get(fs, "d") != filepath.Join(home, "Downloads") {
+		t.Fatalf("dir: %s", get(fs, "d"))
+	}
+
+	t.Setenv("GODOWN_PROXY", "")
+	fs, _ = parse("a.files.example.com")
+	if get(fs, "t") != "3" || get(fs, "bs") != "1048576" || get(fs, "p") != "http://global:8080" {
+		t.Fatalf("wildcard: t=%s bs=%s p=%s", get(fs, "t"), get(fs, "bs"), get(fs, "p"))
+	}
+	fs, headers = parse("other.org")
+	if get(fs, "t") != "6" || get(fs, "user") != "" || len(headers) != 2 {
+		t.Fatalf("global: t=%s user=%s headers=%v", get(fs, "t"), get(fs, "user"), headers)
+	}
+
+	t.Setenv("GODOWN_THREADS", "many")
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("t", 6, "")
+	if err := cfg.Apply(fs, "", &headerFlags{}); err == nil {
+		t.Fatal("invalid env value should be rejected")
+	}
+}
+
+func TestHostHeadersStayOnHost(t *testing.T) {
+	got := make(chan http.Header, 2)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+	}))
+	defer other.Close()
+	_, port, _ := net.SplitHostPort(other.Listener.Addr().String())
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+		http.Redirect(w, r, "http://localhost:"+port+"/file", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	file := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(file, []byte(`
+headers = ["X-Team: infra"]
+
+[hosts."127.0.0.1"]
+headers = ["X-Team: cdn", "X-Token: abc", "Accept-Language: en"]
+`), 0644)
+	cfg, err := LoadConfig(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	headers := headerFlags{"Accept-Language: zh"}
+	if err := cfg.Apply(fs, "127.0.0.1", &headers); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { hostConfig = nil }()
+	hostConfig = cfg
+	header := DefaultHeader.Clone()
+	headers.Apply(header)
+
+	j := &Job{Url: origin.URL + "/file", Header: header}
+	req, err := j.newRequest(context.Background(), "GET", j.Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	first, second := <-got, <-got
+	if first.Get("X-Team") != "cdn" || first.Get("X-Token") != "abc" || first.Get("Accept-Language") != "zh" {
+		t.Fatalf("origin got %v", first)
+	}
+	if second.Get("X-Team") != "infra" || second.Get("X-Token") != "" || second.Get("Accept-Language") != "zh" {
+		t.Fatalf("redirect target got %v", second)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	if cfg, err := LoadConfig(filepath.Join(dir, "missing.toml"), true); err != nil || len(cfg.sections("x")) != 0 {
+		t.Fatalf("missing optional config: %v", err)
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "missing.toml"), false); err == nil {
+		t.Fatal("missing explicit config should fail")
+	}
+	file := filepath.Join(dir, "bad.toml")
+	os.WriteFile(file, []byte("treads = 4\n"), 0644)
+	if _, err := LoadConfig(file, false); err == nil {
+		t.Fatal("unknown key should be rejected")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int{"4096": 4096, "16MiB": 16 << 20, "512k": 512 << 10, "1 GB": 1 << 30, "2M": 2 << 20} {
+		if got, err := parseSize(s); err != nil || got != want {
+			t.Errorf("%s: %d, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "0", "1.5M", "3T", "MiB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+	var free zeroSizeFlag
+	for s, want := range map[string]zeroSizeFlag{"0": 0, " 0 ": 0, "64M": 64 << 20} {
+		if err := free.Set(s); err != nil || free != want {
+			t.Errorf("zero size %q: %d, %v", s, free, err)
+		}
+	}
+	if free.Set("0.5M") == nil {
+		t.Error("0.5M should be rejected")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadCookies 读取 Netscape 格式 (curl/wget) 的 cookies.txt
+func LoadCookies(path string) (*cookiejar.Jar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("%s:%d: expected 7 tab separated fields, got %d", path, n, len(fields))
+		}
+		domain, subdomains, cookiePath, secure, expires, name, value :=
+			fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+
+		c := &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     cookiePath,
+			Secure:   strings.EqualFold(secure, "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(subdomains, "TRUE") {
+			c.Domain = domain
+		}
+		if exp, err := strconv.ParseInt(expires, 10, 64); err == nil && exp > 0 {
+			c.Expires = time.Unix(exp, 0)
+		}
+
+		u := &url.URL{Scheme: "http", Host: strings.TrimPrefix(domain, "."), Path: cookiePath}
+		if c.Secure {
+			u.Scheme = "https"
+		}
+		jar.SetCookies(u, []*http.Cookie{c})
+	}
+	return jar, scanner.Err()
+}
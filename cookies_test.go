@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCookies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	os.WriteFile(path, []byte(`# Netscape HTTP Cookie File
+.example.com	TRUE	/	FALSE	0	session	abc
+#HttpOnly_secure.example.com	FALSE	/	TRUE	4102444800	token	xyz
+expired.example.com	FALSE	/	FALSE	1	old	1
+`), 0644)
+
+	jar, err := LoadCookies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rawUrl, want := range map[string]int{
+		"http://a.example.com/":        1, // session
+		"https://secure.example.com/":  2, // session, token
+		"http://secure.example.com/":   1, // token 仅 https
+		"http://expired.example.com/":  1,
+		"https://other.example.org/xx": 0,
+	} {
+		u, _ := url.Parse(rawUrl)
+		if got := len(jar.Cookies(u)); got != want {
+			t.Errorf("%s: %d cookies, want %d", rawUrl, got, want)
+		}
+	}
+
+	os.WriteFile(path, []byte("broken line\n"), 0644)
+	if _, err = LoadCookies(path); err == nil {
+		t.Fatal("malformed file should fail")
+	}
+}
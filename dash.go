@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mpd DASH 清单中下载需要的部分
+type mpd struct {
+	Type     string      `xml:"type,attr"`
+	Duration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL  string      `xml:"BaseURL"`
+	Periods  []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int                 `xml:"bandwidth,attr"`
+	Width           int                 `xml:"width,attr"`
+	Height          int                 `xml:"height,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale      int64  `xml:"timescale,attr"`
+	Duration       int64  `xml:"duration,attr"`
+	StartNumber    *int64 `xml:"startNumber,attr"`
+	Initialization string `xml:"initialization,attr"`
+	Media          string `xml:"media,attr"`
+	Timeline       []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"SegmentTimeline>S"`
+}
+
+type mpdSegmentList struct {
+	Initialization *struct {
+		SourceURL string `xml:"sourceURL,attr"`
+		Range     string `xml:"range,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// loadDASH 选择视频 AdaptationSet 中的一个 Representation, 展开为分段
+func (j *Job) loadDASH(ctx context.Context, rawUrl string) ([]*segment, string, error) {
+	body, base, err := j.fetchPlaylist(ctx, rawUrl)
+	if err != nil {
+		return nil, "", err
+	}
+	m := &mpd{}
+	if err = xml.Unmarshal(body, m); err != nil {
+		return nil, "", fmt.Errorf("mpd: %w", err)
+	}
+	if m.Type == "dynamic" {
+		return nil, "", errors.New("mpd: live streams are not supported")
+	}
+	if len(m.Periods) == 0 {
+		return nil, "", errors.New("mpd: no periods")
+	}
+	if len(m.Periods) > 1 {
+		log.Warnf("Only the first of %d periods is downloaded", len(m.Periods))
+	}
+	period := &m.Periods[0]
+	if len(period.AdaptationSets) == 0 {
+		return nil, "", errors.New("mpd: no adaptation sets")
+	}
+
+	set := &period.AdaptationSets[0]
+	for i := range period.AdaptationSets {
+		s := &period.AdaptationSets[i]
+		if s.contentType() == "video" {
+			set = s
+			break
+		}
+	}
+	if len(period.AdaptationSets) > 1 {
+		log.Warnf("Only the %s adaptation set is downloaded, %d others are skipped", set.contentType(), len(period.AdaptationSets)-1)
+	}
+
+	vs := make([]variant, len(set.Representations))
+	for i, r := range set.Representations {
+		vs[i] = variant{bandwidth: r.Bandwidth, width: r.Width, height: r.Height}
+	}
+	i, err := pickVariant(vs, streamVariant)
+	if err != nil {
+		return nil, "", err
+	}
+	rep := &set.Representations[i]
+	log.Infof("Variant: %s of %d", vs[i], len(vs))
+
+	for _, ref := range []string{m.BaseURL, period.BaseURL, set.BaseURL, rep.BaseURL} {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			if base, err = base.Parse(ref); err != nil {
+				return nil, "", fmt.Errorf("mpd: %w", err)
+			}
+		}
+	}
+
+	duration := period.Duration
+	if duration == "" {
+		duration = m.Duration
+	}
+	var segs []*segment
+	switch {
+	case rep.SegmentTemplate != nil || set.SegmentTemplate != nil:
+		t := rep.SegmentTemplate
+		if t == nil {
+			t = set.SegmentTemplate
+		}
+		segs, err = t.segments(base, rep, duration)
+	case rep.SegmentList != nil || set.SegmentList != nil:
+		l := rep.SegmentList
+		if l == nil {
+			l = set.SegmentList
+		}
+		segs, err = l.segments(base)
+	default: // SegmentBase 或单个文件
+		segs = []*segment{{url: base.String(), end: -1}}
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("mpd: %w", err)
+	}
+
+	j.contentType = rep.MimeType
+	if j.contentType == "" {
+		j.contentType = set.MimeType
+	}
+	ext := ".mp4"
+	switch j.contentType {
+	case "video/webm", "audio/webm":
+		ext = ".webm"
+	case "audio/mp4":
+		ext = ".m4a"
+	}
+	return segs, ext, nil
+}
+
+func (s *mpdAdaptationSet) contentType() string {
+	if s.ContentType != "" {
+		return s.ContentType
+	}
+	mt := s.MimeType
+	if mt == "" && len(s.Representations) > 0 {
+		mt = s.Representations[0].MimeType
+	}
+	ct, _, _ := strings.Cut(mt, "/")
+	return ct
+}
+
+var templateRe = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth|)(%0\d+d)?\$`)
+
+// expandTemplate 替换 $RepresentationID$, $Number%05d$ 等标识符
+func expandTemplate(tmpl string, rep *mpdRepresentation, number, time int64) string {
+	return templateRe.ReplaceAllStringFunc(tmpl, func(s string) string {
+		m := templateRe.FindStringSubmatch(s)
+		format := m[2]
+		if format == "" {
+			format = "%d"
+		}
+		switch m[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Time":
+			return fmt.Sprintf(format, time)
+		case "Bandwidth":
+			return fmt.Sprintf(format, rep.Bandwidth)
+		}
+		return "$"
+	})
+}
+
+// segments SegmentTimeline 或按固定时长与总时长计算分段数
+func (t *mpdSegmentTemplate) segments(base *url.URL, rep *mpdRepresentation, duration string) ([]*segment, error) {
+	timescale := t.Timescale
+	if timescale == 0 {
+		timescale = 1
+	}
+	number := int64(1)
+	if t.StartNumber != nil {
+		number = *t.StartNumber
+	}
+	var end int64 // 以 timescale 计的总时长, 未知为 0
+	if duration != "" {
+		total, err := parseISODuration(duration)
+		if err != nil {
+			return nil, err
+		}
+		end = int64(math.Ceil(total * float64(timescale)))
+	}
+
+	var segs []*segment
+	add := func(tmpl string, number, time int64) error {
+		ref, err := resolveRef(base, expandTemplate(tmpl, rep, number, time))
+		if err != nil {
+			return err
+		}
+		segs = append(segs, &segment{url: ref, end: -1})
+		return nil
+	}
+	if t.Initialization != "" {
+		if err := add(t.Initialization, 0, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case len(t.Timeline) > 0:
+		var time int64
+		for i, s := range t.Timeline {
+			if s.T != nil {
+				time = *s.T
+			}
+			repeat := s.R
+			if repeat < 0 { // 重复到下一个 S 或周期结束
+				until := end
+				if i+1 < len(t.Timeline) && t.Timeline[i+1].T != nil {
+					until = *t.Timeline[i+1].T
+				}
+				if until <= time || s.D <= 0 {
+					return nil, errors.New("open-ended SegmentTimeline without period duration")
+				}
+				repeat = (until-time+s.D-1)/s.D - 1
+			}
+			for k := int64(0); k <= repeat; k++ {
+				if err := add(t.Media, number, time); err != nil {
+					return nil, err
+				}
+				number++
+				time += s.D
+			}
+		}
+	case t.Duration > 0:
+		if end <= 0 {
+			return nil, errors.New("SegmentTemplate without timeline needs a duration")
+		}
+		for time := int64(0); time < end; time += t.Duration {
+			if err := add(t.Media, number, time); err != nil {
+				return nil, err
+			}
+			number++
+		}
+	default:
+		return nil, errors.New("SegmentTemplate without duration or timeline")
+	}
+	return segs, nil
+}
+
+func (l *mpdSegmentList) segments(base *url.URL) ([]*segment, error) {
+	var segs []*segment
+	add := func(ref, byteRange string) error {
+		u := base.String()
+		if ref != "" {
+			var err error
+			if u, err = resolveRef(base, ref); err != nil {
+				return err
+			}
+		}
+		seg := &segment{url: u, end: -1}
+		if byteRange != "" {
+			s, e, ok := strings.Cut(byteRange, "-")
+			start, err1 := strconv.Atoi(s)
+			end, err2 := strconv.Atoi(e)
+			if !ok || err1 != nil || err2 != nil || end < start {
+				return fmt.Errorf("bad range %q", byteRange)
+			}
+			seg.start, seg.end = start, end
+		}
+		segs = append(segs, seg)
+		return nil
+	}
+	if init := l.Initialization; init != nil {
+		if err := add(init.SourceURL, init.Range); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range l.SegmentURLs {
+		if err := add(s.Media, s.MediaRange); err != nil {
+			return nil, err
+		}
+	}
+	return segs, nil
+}
+
+var isoDurationRe = regexp.MustCompile(`^P(?:([\d.]+)D)?(?:T(?:([\d.]+)H)?(?:([\d.]+)M)?(?:([\d.]+)S)?)?$`)
+
+// parseISODuration "PT1H2M3.5S" 转为秒
+func parseISODuration(s string) (float64, error) {
+	m := isoDurationRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	var secs float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if m[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		secs += v * unit
+	}
+	return secs, nil
+}
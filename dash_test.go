@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseISODuration(t *testing.T) {
+	for s, want := range map[string]float64{
+		"PT634.566S": 634.566,
+		"PT1H2M3S":   3723,
+		"P1DT1M":     86460,
+		"PT0S":       0,
+	} {
+		got, err := parseISODuration(s)
+		if err != nil || got != want {
+			t.Errorf("%s: %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "P", "PT", "1H", "PTxS"} {
+		if _, err := parseISODuration(s); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	rep := &mpdRepresentation{ID: "v1", Bandwidth: 500000}
+	got := expandTemplate("$RepresentationID$/$Bandwidth$/seg-$Number%05d$-$Time$$$.m4s", rep, 42, 90000)
+	if want := "v1/500000/seg-00042-90000$.m4s"; got != want {
+		t.Fatalf("%s, want %s", got, want)
+	}
+}
+
+func TestDASHDownload(t *testing.T) {
+	setupDownload(t, 0, 4)
+
+	files := map[string][]byte{}
+	var want [][]byte
+	add := func(name string, data []byte) {
+		files[name] = data
+		want = append(want, data)
+	}
+	add("/dash/hd/init.mp4", []byte("ftyp-moov"))
+	// t=0 d=2*90000 r=2 -> 3 段, 之后 d=90000 重复到周期结束 (7s) -> 1 段
+	for i, tm := range []int{0, 180000, 360000, 540000} {
+		add(fmt.Sprintf("/dash/hd/seg-%03d-%d.m4s", i+1, tm), randomData(20000+i))
+	}
+	files["/dash/sd/init.mp4"] = []byte("sd")
+
+	manifest := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT7S">
+  <Period>
+    <BaseURL>dash/</BaseURL>
+    <AdaptationSet contentType="audio" mimeType="audio/mp4">
+      <Representation id="a" bandwidth="128000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate timescale="90000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/seg-$Number%03d$-$Time$.m4s">
+        <SegmentTimeline>
+          <S t="0" d="180000" r="2"/>
+          <S d="90000" r="-1"/>
+        </SegmentTimeline>
+      </SegmentTemplate>
+      <Representation id="sd" bandwidth="800000" width="640" height="360"/>
+      <Representation id="hd" bandwidth="3000000" width="1920" height="1080"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/talk.mpd" {
+			w.Write([]byte(manifest))
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/talk.mpd"}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "talk.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.Join(want, nil)) {
+		t.Fatal("content mismatch")
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,8 +12,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,6 +25,12 @@ import (
 const (
 	SRC_NORMAL = iota
 	SRC_MEGA
+	SRC_FTP
+	SRC_SFTP
+	SRC_HLS
+	SRC_DASH
+	SRC_TORRENT
+	SRC_WEBDAV
 )
 
 var (
@@ -33,24 +43,69 @@ var (
 	ErrUnknownSize       = fmt.Errorf("unknown file size")
 	ErrNothingToDownload = fmt.Errorf("nothing to download")
 	ErrNotAcceptRanges   = fmt.Errorf("server does not support range requests")
+	ErrUrlExpired        = fmt.Errorf("download url rejected, probably expired")
+	ErrDiskFull          = fmt.Errorf("not enough disk space")
 )
 
 type Job struct {
-	Url          string
-	finalUrl     string
+	Url      string
+	Header   http.Header // 为空时使用 DefaultHeader
+	Auth     *Auth
+	Checksum *Checksum // 可选, 重命名前校验
+	SubDir   string    // 相对 DownloadsFolder 的子目录, 镜像目录时使用
+
+	finalUrl     string   // 重定向后的地址, 过期时由 refreshFinalUrl 更新
+	redirects    []string // 重定向链, 不含 Url
+	urlMu        sync.RWMutex
+	refreshMu    sync.Mutex
 	fileName     string
 	acceptRanges bool
 	size         int
+	lastModified time.Time
+	etag         string
+	contentType  string
+	proto        string       // 协商的协议, 如 HTTP/2.0
+	headWorks    *bool        // HEAD 是否可用, 未发送时为 nil
+	conns        atomic.Int32 // 新建的连接数
+	active       atomic.Int32 // 正在下载的块数
+	retries      atomic.Int32 // 块的重试次数
+	writerWait   atomic.Int64 // 顺序写入等待下一块的时间
+	writeTime    atomic.Int64 // 写入硬盘的时间
+	verified     []string     // 通过的校验, 如 sha256:...
+	cleanErr     error        // Clean 校验或移动失败
+	report       *Report      // 最近一次下载的统计
+	resumed      atomic.Int64 // 续传时 .part 中已有的字节
+	diskFull     bool         // 空间不足, Clean 时暂停而不是删除 .part
 
-	filePath string
+	filePath string // 最终路径, 完成后确定
+	partPath string // 下载中的临时文件
 
 	ctx      context.Context
 	cancel   context.CancelFunc
+	parent   context.Context // Runner 的 ctx, 为 nil 时自行捕获 Ctrl+C
+	shared   *mpb.Progress   // Runner 共用的进度显示
 	progress *mpb.Progress
 	fs       *os.File
 	Blocks   Blocks
 
-	mega *mega
+	src       int          // SRC_*
+	source    rangeSource  // 非 HTTP 来源
+	segments  []*segment   // HLS/DASH 分段
+	blockSize int          // 来源指定的块大小, 0 时使用 blockSize
+	files     []sourceFile // 多文件来源, 完成后拆分到以 fileName 命名的目录
+	mega      *mega
+	s3        *s3Signer   // s3:// 对象, 请求由 do 签名
+	s3sum     *s3Checksum // 对象的 ETag 与 x-amz-checksum-*
+
+	id           int64                  // plain/json 进度中的任务编号
+	phase        atomic.Int32           // PHASE_*
+	phaseChanged chan struct{}          // 通知 reporter 立即输出
+	received     atomic.Int64           // 已下载字节, 失败的块会扣除
+	written      atomic.Int64           // 已写入 .part 的字节
+	reportBlocks atomic.Pointer[Blocks] // 供 reporter 读取的块列表
+
+	probeResp   *http.Response // 不支持分块时复用探测的 GET 响应
+	probeCancel context.CancelCauseFunc
 
 	// 放结构体里显示顺序全乱, 疑难杂症
 	// totalBar   *mpb.Bar
@@ -59,8 +114,10 @@ type Job struct {
 }
 
 type mega struct {
-	id  string
-	key string
+	id     string
+	key    string
+	ts     int64 // 节点时间戳, 同 FSNode.Ts, 文件链接从属性指纹中取得
+	params *MegaDownloadDataParams
 }
 
 type Blocks []*Block
@@ -69,23 +126,44 @@ type Block struct {
 	index   int
 	start   int
 	end     int
-	Done    chan bool // 同步顺序写入的信号
-	Written int64     // 已写入硬盘的字节数
+	seg     *segment      // HLS/DASH 分段, start/end 为分段内的范围
+	Done    chan bool     // 同步顺序写入的信号
+	Written int64         // 已写入硬盘的字节数
+	state   atomic.Int32  // BLOCK_*
+	took    time.Duration // 成功的那次请求耗时
+	retries int
 	bytes.Buffer
 }
 
-func (j Job) String() string {
+func (j *Job) String() string {
 	var size string
 	if j.size == -1 {
 		size = "[unknown]"
 	} else {
 		size = FormatBytes(j.size)
 	}
-	return fmt.Sprintf("fileName: %s, size: %s, url: %s", j.fileName, size, j.finalUrl)
+	return fmt.Sprintf("fileName: %s, size: %s, proto: %s, url: %s", // 连接数在 logReport 中输出
+		j.fileName, size, j.proto, j.getFinalUrl())
+}
+
+func (j *Job) getFinalUrl() string {
+	j.urlMu.RLock()
+	defer j.urlMu.RUnlock()
+	return j.finalUrl
+}
+
+func (j *Job) setFinalUrl(u string) {
+	j.urlMu.Lock()
+	j.finalUrl = u
+	j.urlMu.Unlock()
 }
 
 func (j *Job) init() error {
-	j.ctx, j.cancel = context.WithCancel(context.Background())
+	parent := j.parent
+	if parent == nil {
+		parent = context.Background()
+	}
+	j.ctx, j.cancel = context.WithCancel(parent)
 	j.progress = j.newProgressWithCtx()
 
 	if j.fileName != "" {
@@ -96,25 +174,79 @@ func (j *Job) init() error {
 	if err != nil {
 		return err
 	}
-	if u.Host == "mega.nz" || u.Host == "mega.co.nz" {
-		j.mega = &mega{
-			id:  path.Base(u.Path),
-			key: u.Fragment,
+	switch {
+	case u.Host == "mega.nz" || u.Host == "mega.co.nz":
+		j.src = SRC_MEGA
+		return j.initMega()
+	case u.Scheme == "ftp" || u.Scheme == "ftps":
+		j.src = SRC_FTP
+		s := NewFtpSource(u, j.authFor(u, true))
+		s.gotConn = func() { j.conns.Add(1) }
+		j.source = s
+		j.proto = strings.ToUpper(u.Scheme)
+		return j.statSource()
+	case u.Scheme == "sftp":
+		j.src = SRC_SFTP
+		s := NewSftpSource(u, j.authFor(u, true))
+		s.gotConn = func() { j.conns.Add(1) }
+		j.source = s
+		j.proto = "SFTP"
+		return j.statSource()
+	case u.Scheme == "dav" || u.Scheme == "davs":
+		j.src = SRC_WEBDAV
+		return j.initDAV(u)
+	case u.Scheme == "s3":
+		if err := j.initS3(u); err != nil {
+			return err
 		}
+	case u.Scheme == "magnet":
+		meta, err := parseMagnet(j.Url)
+		if err != nil {
+			return err
+		}
+		return j.initTorrent(meta, nil)
+	case path.Ext(u.Path) == ".torrent" && (followTorrent || u.Scheme == "" || u.Scheme == "file"): // 本地种子只能按内容下载
+		return j.initTorrent(nil, j.loadTorrent)
+	case path.Ext(u.Path) == ".m3u8":
+		j.src = SRC_HLS
+		return j.initStream()
+	case path.Ext(u.Path) == ".mpd":
+		j.src = SRC_DASH
+		return j.initStream()
 	}
 
-	return j.fetchHeader()
+	err = j.fetchHeader()
+	if err != nil && err != ErrUnknownSize && err != ErrNotAcceptRanges {
+		return err
+	}
+	if followTorrent && strings.HasPrefix(j.contentType, "application/x-bittorrent") {
+		j.closeProbe()
+		return j.initTorrent(nil, j.loadTorrent)
+	}
+	if src := isStreamType(j.contentType); src != SRC_NORMAL {
+		j.src = src
+		return j.initStream()
+	}
+	return err
 }
 
-// fetchHeader 获取文件头信息
+// fetchHeader 获取文件头信息, HEAD 不可用时退化为 GET Range: bytes=0-0
 func (j *Job) fetchHeader() error {
+	if u, err := url.Parse(j.Url); err == nil && j.s3 == nil {
+		if lookupProfile(u.Hostname()).skipHead() {
+			j.logger().Debug("HEAD was unusable on this host before, probing with ranged GET")
+			return j.probeRange()
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(
 		context.Background(),
 		time.Second*30,
 	)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "HEAD", j.Url, nil)
+	ctx = withRedirectLog(ctx, &j.redirects)
+	req, err := j.newRequest(ctx, "HEAD", j.Url)
 	switch err {
 	case context.DeadlineExceeded:
 		return fmt.Errorf("header request timeout")
@@ -125,7 +257,7 @@ func (j *Job) fetchHeader() error {
 		return err
 	}
 
-	resp, err := Client.Do(req)
+	resp, err := j.do(req)
 	switch err {
 	case context.DeadlineExceeded:
 		return fmt.Errorf("header request timeout")
@@ -135,15 +267,110 @@ func (j *Job) fetchHeader() error {
 	default:
 		return err
 	}
-	defer resp.Body.Close()
-	j.finalUrl = resp.Request.URL.String()
+	resp.Body.Close()
 	// PrintHeader(resp.Header)
-	log.Debug(resp.Status)
+	logger := j.logger().WithField("status", resp.StatusCode)
+	logger.Debug(resp.Status)
+
+	// 预签名 URL, 部分 CDN 拒绝 HEAD 或不给出 Content-Length (或给出 0), 由探测决定是否为空文件;
+	// 只有 405/501 与缺少长度记为 HEAD 不可用, 404/403 等可能只是这个文件的问题
+	headWorks := resp.StatusCode < 400 && resp.ContentLength > 0
+	switch {
+	case resp.StatusCode < 400 && resp.ContentLength == 0: // 空文件时 HEAD 也是可用的, 不记录
+	case resp.StatusCode < 400, resp.StatusCode == http.StatusMethodNotAllowed, resp.StatusCode == http.StatusNotImplemented:
+		j.headWorks = &headWorks
+	}
+	if !headWorks {
+		logger.Debugf("HEAD unusable (%s, Content-Length: %d), probing with ranged GET", resp.Status, resp.ContentLength)
+		return j.probeRange()
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("http status: %s", resp.Status)
+	}
+
+	j.parseHeader(resp)
+	j.size = int(resp.ContentLength)
+	j.acceptRanges = strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes")
+	return j.checkSize()
+}
+
+// probeRange 以 GET Range: bytes=0-0 探测大小与分块支持,
+// 206 时读完 1 字节, 连接回到池中供第一个块复用;
+// 200 时保留响应体给单线程下载, 不用时在 Clean 中取消
+func (j *Job) probeRange() error {
+	ctx, cancel := context.WithCancelCause(j.ctx)
+	j.redirects = nil
+	req, err := j.newRequest(withRedirectLog(ctx, &j.redirects), "GET", j.Url)
+	if err != nil {
+		cancel(nil)
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := j.do(req)
+	if err != nil {
+		cancel(nil)
+		return err
+	}
+	j.logger().WithField("status", resp.StatusCode).Debug(resp.Status)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		cancel(nil)
+		j.parseHeader(resp)
+		j.size = parseContentRangeTotal(resp.Header.Get("Content-Range"))
+		j.acceptRanges = j.size >= 0 // bytes 0-0/* 时无法分块, 单线程下载
+
+	case http.StatusOK:
+		j.parseHeader(resp)
+		j.size = int(resp.ContentLength)
+		j.acceptRanges = false
+		j.probeResp, j.probeCancel = resp, cancel
+
+	case http.StatusRequestedRangeNotSatisfiable: // 空文件, Content-Range: bytes */0
+		resp.Body.Close()
+		cancel(nil)
+		if parseContentRangeTotal(resp.Header.Get("Content-Range")) != 0 {
+			return fmt.Errorf("http status: %s", resp.Status)
+		}
+		j.parseHeader(resp)
+		j.size = 0
+
+	default:
+		resp.Body.Close()
+		cancel(nil)
+		return fmt.Errorf("http status: %s", resp.Status)
+	}
+	return j.checkSize()
+}
+
+// parseContentRangeTotal "bytes 0-0/12345" 取总大小, 未知时为 -1
+func parseContentRangeTotal(cr string) int {
+	_, total, ok := strings.Cut(cr, "/")
+	if !ok {
+		return -1
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(total))
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// parseHeader 文件名, 最终地址等元信息
+func (j *Job) parseHeader(resp *http.Response) {
+	j.setFinalUrl(resp.Request.URL.String())
+	j.proto = resp.Proto
+	if httpVersion != "" && !strings.HasPrefix(resp.Proto, "HTTP/"+httpVersion) {
+		j.logger().Warnf("Requested HTTP/%s but server negotiated %s", httpVersion, resp.Proto)
+	}
 
 	filename := strings.Split(resp.Header.Get("Content-Disposition"), ";")
 	for _, fn := range filename {
 		if strings.Contains(fn, "filename=") {
-			j.fileName = strings.Split(fn, "filename=")[1]
+			j.fileName = strings.Trim(strings.Split(fn, "filename=")[1], `"`)
 			break
 		}
 	}
@@ -151,32 +378,107 @@ func (j *Job) fetchHeader() error {
 		j.fileName = path.Base(resp.Request.URL.Path)
 	}
 
-	j.size = int(resp.ContentLength)
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		j.lastModified = lm
+	}
+	j.etag = resp.Header.Get("ETag")
+	j.contentType = resp.Header.Get("Content-Type")
+	if j.s3 != nil && resp.Request.Method == "HEAD" {
+		j.s3sum = parseS3Header(resp.Header)
+	}
+}
+
+func (j *Job) checkSize() error {
 	switch j.size {
 	case -1:
 		return ErrUnknownSize
 	case 0:
 		return ErrNothingToDownload
 	}
-
-	j.acceptRanges = strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes")
 	if !j.acceptRanges {
 		return ErrNotAcceptRanges
 	}
+	return nil
+}
+
+// urlExpiredError 块请求被拒绝, 需要重新解析 finalUrl
+type urlExpiredError struct {
+	url    string
+	status string
+}
+
+func (e *urlExpiredError) Error() string {
+	return fmt.Sprintf("%v (%s)", ErrUrlExpired, e.status)
+}
+
+func (e *urlExpiredError) Unwrap() error { return ErrUrlExpired }
 
+// refreshFinalUrl 从 Job.Url 重新走一遍重定向, 其他线程已刷新时直接返回
+func (j *Job) refreshFinalUrl(stale string) error {
+	j.refreshMu.Lock()
+	defer j.refreshMu.Unlock()
+	if j.getFinalUrl() != stale {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(j.ctx, time.Second*30)
+	defer cancel()
+	var redirects []string
+	req, err := j.newRequest(withRedirectLog(ctx, &redirects), "GET", j.Url)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := j.do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("http status: %s", resp.Status)
+	}
+	if size := parseContentRangeTotal(resp.Header.Get("Content-Range")); size != j.size {
+		return fmt.Errorf("file size changed: %d -> %d", j.size, size)
+	}
+	finalUrl := resp.Request.URL.String()
+	if finalUrl == stale {
+		return fmt.Errorf("url unchanged after refresh")
+	}
+	j.redirects = redirects
+	j.setFinalUrl(finalUrl)
+	j.logger().Infof("Refreshed download url via %d redirects", len(redirects))
 	return nil
 }
 
-// splitBlocks 初始化块信息
+// splitBlocks 初始化块信息, HLS/DASH 每个分段一个块
 func (j *Job) splitBlocks() {
-	numBlocks := (j.size + blockSize - 1) / blockSize
+	if j.segments != nil {
+		j.Blocks = make(Blocks, len(j.segments))
+		for i, seg := range j.segments {
+			j.Blocks[i] = &Block{
+				index: i,
+				start: seg.start,
+				end:   seg.end,
+				seg:   seg,
+			}
+		}
+		return
+	}
+
+	bs := blockSize
+	if j.blockSize > 0 {
+		bs = j.blockSize
+	}
+	numBlocks := (j.size + bs - 1) / bs
 	if numBlocks < 1 {
 		numBlocks = 1
 	}
 	j.Blocks = make(Blocks, numBlocks)
 	for i := 0; i < numBlocks; i++ {
-		start := blockSize * i     // 左闭
-		end := blockSize*(i+1) - 1 // 右闭
+		start := bs * i     // 左闭
+		end := bs*(i+1) - 1 // 右闭
 		if i == numBlocks-1 {
 			end = j.size - 1
 		}
@@ -188,14 +490,23 @@ func (j *Job) splitBlocks() {
 	}
 }
 
-// createFile 创建文件
+// createFile 创建 .part 临时文件, 完成后由 Clean 重命名
 func (j *Job) createFile() {
-	if j.fs != nil {
+	if j.fs != nil { // 重试时从头写入
+		j.fs.Truncate(0)
+		j.fs.Seek(0, io.SeekStart)
 		return
 	}
 
-	j.filePath = GetUniqueFilePath(filepath.Join(DownloadsFolder, j.fileName))
-	fs, err := os.Create(j.filePath)
+	dir := j.partDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Panic(err)
+	}
+	if j.resume(dir) {
+		return
+	}
+	j.partPath = GetUniqueFilePath(filepath.Join(dir, j.fileName+".part"))
+	fs, err := os.Create(j.partPath)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -212,26 +523,99 @@ func (j *Job) setupChannels() {
 }
 
 func (j *Job) Start() {
+	report := j.startReporter()
+	var err error
+	defer func() { report(err) }()
 S:
-	err := j.init()
+	if err = j.prepare(); err != nil {
+		report(err)
+		log.Fatalf("Failed to init job: %v", err)
+	}
+	err = j.download()
+	if reportFile != "" && j.report != nil {
+		if werr := writeReport(reportFile, j.report); werr != nil {
+			log.Errorf("Failed to write report: %v", werr)
+		}
+	}
 	switch err {
 	case nil:
-		j.splitBlocks()
-
-	case ErrUnknownSize:
-	case ErrNotAcceptRanges:
+	case context.Canceled:
+		log.Warn("Download canceled")
 
 	default:
-		log.Fatalf("Failed to init job: %v", err)
+		log.Errorf("Download failed: %v\n", err)
+		fmt.Print("Retry? (y/n): ")
+		var input string
+		fmt.Scanln(&input)
+		if strings.TrimSpace(strings.ToLower(input)) == "y" {
+			goto S
+		}
 
 	}
+
+}
+
+// Run 不询问重试, 出错时返回, 供 Runner 使用
+func (j *Job) Run() (err error) {
+	report := j.startReporter()
+	defer func() { report(err) }()
+	if err = j.prepare(); err != nil {
+		err = fmt.Errorf("init job: %w", err)
+		j.report = &Report{Url: redactUrl(j.Url), Status: "failed", Error: err.Error(), Size: -1, Start: time.Now()}
+		return err
+	}
+	return j.download()
+}
+
+// prepare 获取文件信息并分块, 大小未知或不支持分块时不分块
+func (j *Job) prepare() error {
+	j.setPhase(PHASE_PROBING)
+	j.reportBlocks.Store(nil)
+	j.received.Store(0)
+	j.written.Store(0)
+	j.retries.Store(0)
+	j.writerWait.Store(0)
+	j.writeTime.Store(0)
+	j.verified, j.cleanErr, j.report = nil, nil, nil
+	j.resumed.Store(0)
+	j.diskFull = false
+	switch err := j.init(); err {
+	case nil:
+		j.splitBlocks()
+		blocks := j.Blocks
+		j.reportBlocks.Store(&blocks)
+	case ErrUnknownSize, ErrNotAcceptRanges:
+	default:
+		return err
+	}
+	return nil
+}
+
+// download 下载到 .part, 结束后由 Clean 校验并重命名, 统计保存到 j.report
+func (j *Job) download() (err error) {
 	j.createFile()
 	log.Info(j)
+	j.setPhase(PHASE_DOWNLOADING)
 
-	go catchSigs(j.ctx, j.cancel) // 捕获 Ctrl+C
-	defer j.Clean()               // 退出时清理
-
+	if j.parent == nil {
+		go catchSigs(j.ctx, j.cancel) // 捕获 Ctrl+C
+	}
 	timeStart := time.Now()
+	sampler := j.sampleThroughput()
+	defer func() {
+		peak := sampler.Stop()
+		j.Clean() // 退出时清理
+		if err == nil {
+			err = j.cleanErr // 校验或移动失败也算失败
+		}
+		j.report = j.buildReport(timeStart, peak, err)
+		j.report.logReport()
+		j.learnProfile()
+	}()
+	if err = j.checkSpace(); err != nil {
+		return err
+	}
+
 	wg := &sync.WaitGroup{}
 	if j.acceptRanges {
 		err = j.DownloadMultiThread(wg)
@@ -243,50 +627,170 @@ S:
 		}
 		err = j.DownloadSingleThread(wg)
 	}
-	switch err {
-	case nil:
-		wg.Wait()
-		timeEnd := time.Since(timeStart)
+	if err != nil {
+		j.cancel()
+		return err
+	}
+	j.setPhase(PHASE_WRITING) // 等待剩余的块写入
+	wg.Wait()
+	if showThreadProgressBar {
 		<-time.After(time.Millisecond * 400) // 等待进度条移除
-		log.Infof("Downloaded in %v", timeEnd)
-	case context.Canceled:
-		log.Warn("Download canceled")
+	}
+	return nil
+}
 
-	default:
-		j.cancel()
+// Clean 校验 .part 文件, 通过后重命名到下载目录
+func (j *Job) Clean() {
+	j.closeProbe()
+	if j.source != nil {
+		j.source.Close()
+	}
+	if j.fs == nil { // 重试时会注册多次
+		return
+	}
+	defer func() { j.fs = nil }()
 
-		log.Errorf("Download failed: %v\n", err)
-		fmt.Print("Retry? (y/n): ")
-		var input string
-		fmt.Scanln(&input)
-		if strings.TrimSpace(strings.ToLower(input)) == "y" {
-			goto S
+	if err := j.fs.Sync(); err != nil {
+		log.Errorf("Failed to sync file: %v", err)
+	}
+	j.fs.Close()
+
+	fileInfo, err := os.Stat(j.partPath)
+	if err != nil {
+		log.Fatalf("Failed to get file info: %v", err)
+	}
+	if j.size != -1 && fileInfo.Size() != int64(j.size) || !j.segmentsWritten() { // 未完成下载
+		if j.pause() {
+			return
 		}
+		os.Remove(j.partPath)
+		os.Remove(resumePath(j.partPath))
+		return
+	}
+	os.Remove(resumePath(j.partPath))
+	if j.Checksum != nil || j.s3sum != nil {
+		j.setPhase(PHASE_VERIFYING)
+	}
+	if j.Checksum != nil {
+		if err := j.Checksum.Verify(j.partPath); err != nil {
+			log.Errorf("Checksum verification failed, keeping %s: %v", j.partPath, err)
+			j.cleanErr = err
+			return
+		}
+		log.Infof("Checksum verified: %s", j.Checksum)
+		j.verified = append(j.verified, j.Checksum.String())
+	}
+	if err := j.verifyS3(j.partPath); err != nil {
+		log.Errorf("Checksum verification failed, keeping %s: %v", j.partPath, err)
+		j.cleanErr = err
+		return
+	}
 
+	dir := filepath.Join(DownloadsFolder, j.SubDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Errorf("Failed to create %s: %v", dir, err)
+		j.cleanErr = err
+		return
 	}
+	j.filePath = GetUniqueFilePath(filepath.Join(dir, j.fileName))
+	if j.files != nil {
+		if err := splitFiles(j.partPath, j.filePath, j.files); err != nil {
+			log.Errorf("Failed to extract files from %s: %v", j.partPath, err)
+			j.cleanErr = err
+			return
+		}
+		os.Remove(j.partPath)
+		j.setPhase(PHASE_DONE)
+		log.Infof("Downloaded %d files into: %s", len(j.files), Hyperlink(j.filePath))
+		return
+	}
+	if err := moveFile(j.partPath, j.filePath); err != nil {
+		log.Errorf("Failed to move %s to %s: %v", j.partPath, j.filePath, err)
+		j.cleanErr = err
+		return
+	}
+	if mt := j.modTime(); !mt.IsZero() {
+		if err := os.Chtimes(j.filePath, mt, mt); err != nil {
+			j.logger().Warnf("Failed to set modification time: %v", err)
+		}
+	}
+	if writeXattrs {
+		j.setXattrs()
+	}
+	j.setPhase(PHASE_DONE)
+	log.Infof("Downloaded file: %s", Hyperlink(j.filePath)) // 打印路径
+}
 
+// closeProbe 关闭未被使用的探测响应
+func (j *Job) closeProbe() {
+	if j.probeResp != nil {
+		j.probeResp.Body.Close()
+		j.probeCancel(nil)
+		j.probeResp, j.probeCancel = nil, nil
+	}
 }
 
-func (j *Job) Clean() {
-	j.fs.Close()
+// segmentsWritten 分段任务大小未知, 以所有块都已写入判断完成
+func (j *Job) segmentsWritten() bool {
+	if j.segments == nil {
+		return true
+	}
+	for _, block := range j.Blocks {
+		if block.Written == 0 {
+			return false
+		}
+	}
+	return len(j.Blocks) > 0
+}
 
-	fileInfo, err := os.Stat(j.filePath)
-	if err != nil {
-		log.Fatalf("Failed to get file info: %v", err)
+// modTime 服务端修改时间, 优先 Last-Modified, 其次 MEGA 节点时间戳
+func (j *Job) modTime() time.Time {
+	if !j.lastModified.IsZero() {
+		return j.lastModified
+	}
+	if j.mega != nil && j.mega.ts > 0 {
+		return time.Unix(j.mega.ts, 0)
+	}
+	return time.Time{}
+}
+
+// setXattrs 写入来源信息到扩展属性, 同 wget --xattr
+func (j *Job) setXattrs() {
+	attrs := map[string]string{}
+	if u, err := url.Parse(j.Url); err == nil {
+		u.User = nil // 不保存凭据
+		attrs["user.xdg.origin.url"] = u.String()
+	}
+	if j.contentType != "" {
+		attrs["user.mime_type"] = j.contentType
+	}
+	if j.etag != "" {
+		attrs["user.etag"] = j.etag
 	}
-	if j.size != -1 && fileInfo.Size() != int64(j.size) { // 未完成下载
-		os.Remove(j.filePath)
-	} else { // 打印路径
-		log.Infof("Downloaded file: %s", Hyperlink(j.filePath))
+	if j.Checksum != nil {
+		attrs["user.checksum."+j.Checksum.Algo] = hex.EncodeToString(j.Checksum.Sum)
+	}
+	for name, value := range attrs {
+		if err := SetXattr(j.filePath, name, value); err != nil {
+			j.logger().Warnf("Failed to set xattr %s: %v", name, err)
+			return
+		}
 	}
 }
 
 func (j *Job) DownloadMultiThread(wg *sync.WaitGroup) (err error) {
-	wg.Add(len(j.Blocks))
+	for _, block := range j.Blocks {
+		if block.Written == 0 { // 续传时已写入的块不再等待
+			wg.Add(1)
+		}
+	}
 	j.setupChannels()
+	merged := make(chan struct{})
+	var mergeErr error
 	go func() {
-		err := j.MergeIntoFileSyncSeq(wg)
-		switch err {
+		defer close(merged)
+		mergeErr = j.MergeIntoFileSyncSeq(wg)
+		switch mergeErr {
 		case nil:
 		case context.Canceled:
 		default:
@@ -294,6 +798,15 @@ func (j *Job) DownloadMultiThread(wg *sync.WaitGroup) (err error) {
 		}
 	}()
 	err = j.DownloadIntoRam()
+	if err != nil {
+		j.cancel() // 等待写入协程退出后才能清理文件
+	} else {
+		j.setPhase(PHASE_WRITING)
+	}
+	<-merged // 写入失败时 wg 不会归零
+	if mergeErr != nil && mergeErr != context.Canceled {
+		err = mergeErr // 下载协程只会看到 canceled
+	}
 	if err != nil && err != context.Canceled && strings.Contains(err.Error(), "context canceled") {
 		err = context.Canceled // http 会包装 context.Canceled
 	}
@@ -304,27 +817,81 @@ func (j *Job) DownloadSingleThread(wg *sync.WaitGroup) (err error) {
 	wg.Add(1)
 	defer wg.Done()
 
-	req, err := http.NewRequestWithContext(j.ctx, "GET", j.finalUrl, nil)
+	if j.source != nil {
+		return j.downloadSourceSingleThread()
+	}
+
+	resp, cancel := j.probeResp, j.probeCancel
+	j.probeResp, j.probeCancel = nil, nil
+	if resp == nil {
+		var ctx context.Context
+		ctx, cancel = context.WithCancelCause(j.ctx)
+		req, err := j.newRequest(ctx, "GET", j.getFinalUrl())
+		if err != nil {
+			cancel(nil)
+			return err
+		}
+		resp, err = j.do(req)
+		if err != nil {
+			cancel(nil)
+			return err
+		}
+	}
+	defer cancel(nil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status: %s", resp.Status)
+	}
+
+	stall := newStallReader(resp.Body, stallTimeout, cancel)
+	defer stall.Stop()
+	var src io.Reader = &countReader{stall, []*atomic.Int64{&j.received, &j.written}}
+	if showThreadProgressBar {
+		src = j.newUnknownSizeBar().ProxyReader(io.NopCloser(src))
+	}
+	_, err = io.Copy(j.fs, src)
 	if err != nil {
+		if isDiskFull(err) {
+			j.diskFull = true
+			return fmt.Errorf("%w: %v", ErrDiskFull, err)
+		}
+		if cause := context.Cause(resp.Request.Context()); cause == ErrStalled {
+			return cause
+		}
 		return err
 	}
-	resp, err := Client.Do(req)
+
+	return nil
+}
+
+// downloadSourceSingleThread 从 rangeSource 整体读取
+func (j *Job) downloadSourceSingleThread() error {
+	ctx, cancel := context.WithCancelCause(j.ctx)
+	defer cancel(nil)
+
+	body, err := j.source.OpenRange(ctx, 0, j.size-1)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
-	var src io.ReadCloser
+	stall := newStallReader(body, stallTimeout, cancel)
+	defer stall.Stop()
+	var src io.Reader = &countReader{stall, []*atomic.Int64{&j.received, &j.written}}
 	if showThreadProgressBar {
-		src = j.newUnknownSizeBar().ProxyReader(resp.Body)
-	} else {
-		src = resp.Body
+		src = j.newUnknownSizeBar().ProxyReader(io.NopCloser(src))
 	}
 	_, err = io.Copy(j.fs, src)
 	if err != nil {
+		if isDiskFull(err) {
+			j.diskFull = true
+			return fmt.Errorf("%w: %v", ErrDiskFull, err)
+		}
+		if cause := context.Cause(ctx); cause == ErrStalled {
+			return cause
+		}
 		return err
 	}
-
 	return nil
 }
 
@@ -334,13 +901,18 @@ func (j *Job) DownloadIntoRam() error {
 	var totalBar *mpb.Bar
 	if showTotalProgressBar {
 		totalBar = j.newTotalBar()
+		if j.size > 0 {
+			defer j.trackTotalBar(totalBar)()
+		}
+		summaryBar := j.newSummaryBar(startTime)
+		defer summaryBar.SetTotal(-1, true)
 	}
 
 	wg := &sync.WaitGroup{}
 	limiter := NewLimiter(threadNum)
 	errChan := make(chan error, len(j.Blocks))
 	for _, block := range j.Blocks {
-		if block.Len() != 0 { // 未完成的块一定为 0
+		if block.Len() != 0 || block.Written > 0 { // 未完成的块一定为 0
 			continue
 		}
 
@@ -358,7 +930,7 @@ func (j *Job) DownloadIntoRam() error {
 				switch err {
 				case nil: // 成功, 报告 Done 后释放
 					block.Done <- true
-					if showTotalProgressBar {
+					if showTotalProgressBar && j.size <= 0 {
 						totalBar.EwmaIncrement(time.Since(startTime))
 					}
 					return
@@ -367,9 +939,30 @@ func (j *Job) DownloadIntoRam() error {
 					return
 				default:
 				}
-				<-time.After(time.Second * time.Duration(1+i)) // 重试间隔
+				if j.ctx.Err() != nil { // 任务已取消, 如写入失败, 不再重试
+					errChan <- j.ctx.Err()
+					return
+				}
+				logger := j.logger().WithFields(log.Fields{"block": block.index, "attempt": i + 1})
+				logger.Debugf("Block %d failed: %v", block.index, err)
+				var expired *urlExpiredError
+				if errors.As(err, &expired) {
+					logger = logger.WithField("status", expired.status)
+					if rerr := j.refreshFinalUrl(expired.url); rerr != nil {
+						logger.Warnf("Failed to refresh download url: %v", rerr)
+					}
+				}
+				if i+1 < autoRetry {
+					j.retries.Add(1)
+					block.retries++
+				}
+				select { // 重试间隔
+				case <-time.After(time.Second * time.Duration(1+i)):
+				case <-j.ctx.Done():
+				}
 			}
 			// 失败 autoRetry 次, 报告 Done, err 后释放
+			block.state.Store(BLOCK_FAILED)
 			block.Done <- false
 			errChan <- err
 		}(block)
@@ -381,43 +974,100 @@ func (j *Job) DownloadIntoRam() error {
 		close(errChan)
 	}()
 
+	// 出错时取消其余的块, 等所有协程退出后返回
+	var first error
 	for err := range errChan {
-		if err != nil {
-			return err
+		if err != nil && first == nil {
+			first = err
+			j.cancel()
 		}
 	}
-	return nil
+	return first
 }
 
 // downloadBlock 下载块
 func (j *Job) downloadBlock(block *Block) error {
-	req, err := http.NewRequestWithContext(j.ctx, "GET", j.finalUrl, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", block.start, block.end))
+	ctx, cancel := context.WithCancelCause(j.ctx)
+	defer cancel(nil)
 
-	resp, err := Client.Do(req)
+	block.state.Store(BLOCK_ACTIVE)
+	attemptStart := time.Now()
+	body, err := j.openBlock(ctx, block)
 	if err != nil {
+		block.state.Store(BLOCK_PENDING)
 		return err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
+	j.active.Add(1)
+	defer j.active.Add(-1)
 
-	var src io.ReadCloser
+	stall := newStallReader(body, stallTimeout, cancel)
+	defer stall.Stop()
+	var src io.Reader = &countReader{stall, []*atomic.Int64{&j.received}}
 	if showThreadProgressBar {
-		src = j.newThreadBar(block).ProxyReader(resp.Body)
-	} else {
-		src = resp.Body
+		bar := j.newThreadBar(block)
+		defer bar.EnableTriggerComplete() // 长度未知的分段
+		src = bar.ProxyReader(io.NopCloser(src))
+	}
+	n, err := io.Copy(block, src)
+	if err == nil && block.seg != nil && block.seg.key != nil {
+		err = j.decryptSegment(ctx, block)
 	}
-	_, err = io.Copy(block, src)
 	if err != nil {
+		j.received.Add(-n) // 重试时重新计数
+		block.state.Store(BLOCK_PENDING)
 		block.Reset() // 保证未完成的块一定为 0
+		if cause := context.Cause(ctx); cause == ErrStalled {
+			return fmt.Errorf("block %d: %w", block.index, cause)
+		}
 		return err
 	}
-
+	block.took = time.Since(attemptStart)
+	block.state.Store(BLOCK_DOWNLOADED)
 	return nil
 }
 
+// openBlock 打开块的数据流, 非 HTTP 来源交给 rangeSource
+func (j *Job) openBlock(ctx context.Context, block *Block) (io.ReadCloser, error) {
+	if j.source != nil {
+		return j.source.OpenRange(ctx, block.start, block.end)
+	}
+	if j.mega != nil {
+		return j.openMegaBlock(ctx, block)
+	}
+	if block.seg != nil {
+		return j.openSegment(ctx, block)
+	}
+
+	finalUrl := j.getFinalUrl()
+	req, err := j.newRequest(ctx, "GET", finalUrl)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", block.start, block.end))
+
+	resp, err := j.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK: // 整个文件只有一个块
+		if block.start == 0 && block.end == j.size-1 {
+			return resp.Body, nil
+		}
+		err = fmt.Errorf("block %d: server ignored range request", block.index)
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusGone:
+		err = &urlExpiredError{url: finalUrl, status: resp.Status}
+	default:
+		err = fmt.Errorf("block %d: http status: %s", block.index, resp.Status)
+	}
+	resp.Body.Close()
+	return nil, err
+}
+
 // MergeIntoFile 一次性合并到文件
 func (j *Job) MergeIntoFile() error {
 	var err error
@@ -432,12 +1082,11 @@ func (j *Job) MergeIntoFile() error {
 
 // MergeIntoFileSyncSeq 同步顺序写入到文件
 func (j *Job) MergeIntoFileSyncSeq(wg *sync.WaitGroup) error {
-	var dst io.WriteCloser
+	var dst io.Writer = &countWriter{j.fs, &j.written}
 	if showTotalProgressBar {
 		writingBar := j.newWritingBar()
-		dst = writingBar.ProxyWriter(j.fs)
-	} else {
-		dst = j.fs
+		writingBar.SetCurrent(j.resumed.Load())
+		dst = writingBar.ProxyWriter(dst)
 	}
 
 	var err error
@@ -446,19 +1095,29 @@ func (j *Job) MergeIntoFileSyncSeq(wg *sync.WaitGroup) error {
 			continue
 		}
 
+		waitStart := time.Now()
 		select {
 		case <-j.ctx.Done():
 			return j.ctx.Err()
 
 		case done := <-block.Done:
+			j.writerWait.Add(int64(time.Since(waitStart)))
 			if !done {
 				return fmt.Errorf("block %d download failed", i)
 			}
+			writeStart := time.Now()
 			block.Written, err = io.Copy(dst, block)
+			j.writeTime.Add(int64(time.Since(writeStart)))
 			if err != nil {
+				block.Written = 0 // 只写入了一部分, 续传时重新下载
+				if isDiskFull(err) {
+					j.diskFull = true
+					return fmt.Errorf("%w: writing block %d: %v", ErrDiskFull, i, err)
+				}
 				return err
 			}
 			block.Reset() // 释放内存
+			block.state.Store(BLOCK_WRITTEN)
 			wg.Done()
 
 		}
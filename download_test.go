@@ -1,13 +1,321 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// newTestServer 本地文件服务器, 支持 HEAD, Range 与 Last-Modified
+func newTestServer(t *testing.T, name string, data []byte, modTime time.Time) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func randomData(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// setupDownload 下载测试的公共设置, bs/threads 为 0 时保持默认, 结束时恢复全局变量
+func setupDownload(t *testing.T, bs, threads int) {
+	t.Helper()
+	folder, oldBs, oldThreads, total, thread := DownloadsFolder, blockSize, threadNum, showTotalProgressBar, showThreadProgressBar
+	t.Cleanup(func() {
+		DownloadsFolder, blockSize, threadNum = folder, oldBs, oldThreads
+		showTotalProgressBar, showThreadProgressBar = total, thread
+	})
+	DownloadsFolder = t.TempDir()
+	if bs > 0 {
+		blockSize = bs
+	}
+	if threads > 0 {
+		threadNum = threads
+	}
+	showTotalProgressBar, showThreadProgressBar = false, false
+}
+
+func TestPartFileRename(t *testing.T) {
+	setupDownload(t, 64*1024, 0)
+
+	data := randomData(blockSize*3 + 123)
+	modTime := time.Date(2024, 10, 2, 11, 33, 1, 0, time.UTC)
+	srv := newTestServer(t, "random.bin", data, modTime)
+
+	j := &Job{Url: srv.URL + "/random.bin"}
+	j.Start()
+
+	if _, err := os.Stat(j.partPath); !os.IsNotExist(err) {
+		t.Fatalf(".part file should be renamed: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "random.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+	fi, _ := os.Stat(j.filePath)
+	if !fi.ModTime().Equal(modTime) {
+		t.Fatalf("mtime: %v, want %v", fi.ModTime(), modTime)
+	}
+}
+
+func TestPartFileChecksumMismatch(t *testing.T) {
+	setupDownload(t, 0, 0)
+
+	srv := newTestServer(t, "hello.txt", []byte("hello"), time.Now())
+	c, _ := ParseChecksum("md5:00000000000000000000000000000000")
+	j := &Job{Url: srv.URL + "/hello.txt", Checksum: c}
+	j.Start()
+
+	if _, err := os.Stat(j.partPath); err != nil {
+		t.Fatalf(".part file should be kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(DownloadsFolder, "hello.txt")); !os.IsNotExist(err) {
+		t.Fatal("file should not be renamed")
+	}
+}
+
+func TestRunnerChecksumFailure(t *testing.T) {
+	setupDownload(t, 0, 0)
+
+	srv := newTestServer(t, "hello.txt", []byte("hello"), time.Now())
+	bad, _ := ParseChecksum("md5:00000000000000000000000000000000")
+	good, _ := ParseChecksum("md5:5d41402abc4b2a76b9719d911017c592")
+	r := &Runner{Parallel: 2}
+	r.Add(&Job{Url: srv.URL + "/hello.txt", Checksum: bad})
+	r.Add(&Job{Url: srv.URL + "/hello.txt", Checksum: good, SubDir: "ok"})
+	if failed := r.Run(); failed != 1 {
+		t.Fatalf("failed: %d, want 1", failed)
+	}
+	if r.Jobs[0].report.Status != "failed" || r.Jobs[1].report.Status != "done" {
+		t.Fatalf("status: %s, %s", r.Jobs[0].report.Status, r.Jobs[1].report.Status)
+	}
+}
+
+func TestParseContentRangeTotal(t *testing.T) {
+	for cr, want := range map[string]int{
+		"bytes 0-0/12345": 12345,
+		"bytes 0-0/*":     -1,
+		"":                -1,
+	} {
+		if got := parseContentRangeTotal(cr); got != want {
+			t.Errorf("%q: %d, want %d", cr, got, want)
+		}
+	}
+}
+
+func TestHeadFallback(t *testing.T) {
+	data := randomData(1024*100 + 7)
+	for name, handler := range map[string]http.HandlerFunc{
+		"head 405": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		},
+		"head zero length": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.Header().Set("Content-Length", "0")
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		},
+		"head without length": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" { // 不写 Content-Length
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setupDownload(t, 1024*16, 0)
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			j := &Job{Url: srv.URL + "/fallback.bin"}
+			if err := j.init(); err != nil {
+				t.Fatal(err)
+			}
+			if j.size != len(data) || !j.acceptRanges {
+				t.Fatalf("size: %d, acceptRanges: %v", j.size, j.acceptRanges)
+			}
+			j.Start()
+			got, _ := os.ReadFile(j.filePath)
+			if !bytes.Equal(got, data) {
+				t.Fatal("content mismatch")
+			}
+		})
+	}
+}
+
+func TestUnknownRangeTotal(t *testing.T) {
+	setupDownload(t, 1024, 0)
+
+	data := randomData(5000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.Header.Get("Range") != "":
+			w.Header().Set("Content-Range", "bytes 0-0/*")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[:1])
+		default:
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/unknown.bin"}
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if j.acceptRanges {
+		t.Fatal("unknown total should not be split into blocks")
+	}
+	if got, _ := os.ReadFile(j.filePath); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestEmptyFile(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"head ok": func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(nil))
+		},
+		"head 405": func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(nil)) // 416, bytes */0
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setupDownload(t, 0, 0)
+			srv := httptest.NewServer(handler)
+			defer srv.Close()
+
+			j := &Job{Url: srv.URL + "/empty.txt"}
+			if err := j.init(); err != ErrNothingToDownload {
+				t.Fatalf("want ErrNothingToDownload, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHeadFallbackReuseBody(t *testing.T) {
+	setupDownload(t, 0, 0)
+
+	data := randomData(1024 * 10)
+	gets := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusForbidden) // 预签名 URL 只对 GET 签名
+			return
+		}
+		gets++
+		w.Write(data) // 忽略 Range
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/presigned.bin?X-Amz-Signature=x"}
+	j.Start()
+	if gets != 1 {
+		t.Fatalf("%d GET requests, want 1", gets)
+	}
+	got, _ := os.ReadFile(filepath.Join(DownloadsFolder, "presigned.bin"))
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(r.URL.Path, "/r/%d", &n)
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/r/%d", n-1), http.StatusFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("hello")))
+	}))
+	defer srv.Close()
+
+	defer func(n int) { maxRedirects = n }(maxRedirects)
+	maxRedirects = 3
+
+	j := &Job{Url: srv.URL + "/r/3"}
+	if err := j.init(); err != ErrNotAcceptRanges && err != nil {
+		t.Fatal(err)
+	}
+	if len(j.redirects) != 3 || j.getFinalUrl() != srv.URL+"/r/0" {
+		t.Fatalf("redirects: %v, finalUrl: %s", j.redirects, j.getFinalUrl())
+	}
+
+	j = &Job{Url: srv.URL + "/r/4"}
+	if err := j.init(); err == nil {
+		t.Fatal("4 redirects should exceed the limit")
+	}
+}
+
+func TestUrlExpiryRefresh(t *testing.T) {
+	setupDownload(t, 1024*16, 0)
+
+	data := randomData(blockSize*12 + 1)
+	var gen, served, resolves atomic.Int32
+	gen.Store(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file.bin" {
+			resolves.Add(1)
+			http.Redirect(w, r, fmt.Sprintf("/signed/%d/file.bin", gen.Load()), http.StatusFound)
+			return
+		}
+		var n int32
+		fmt.Sscanf(r.URL.Path, "/signed/%d/", &n)
+		if n != gen.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if rg := r.Header.Get("Range"); rg != "" && rg != "bytes=0-0" && served.Add(1) == 4 {
+			gen.Add(1) // 签名过期
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/file.bin"}
+	j.Start()
+
+	got, _ := os.ReadFile(j.filePath)
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+	if resolves.Load() < 2 {
+		t.Fatalf("url resolved %d times, want a refresh", resolves.Load())
+	}
+	if !strings.Contains(j.getFinalUrl(), "/signed/2/") {
+		t.Fatalf("finalUrl not refreshed: %s", j.getFinalUrl())
+	}
+}
+
 func TestGetHeader(t *testing.T) {
 	j := &Job{
 		Url: "https://pkg.biligame.com/games/mrfz_2.3.81_20241002_113301_738f9.apk",
@@ -95,3 +403,19 @@ func TestPathJoin(t *testing.T) {
 	fmt.Println(path.Join(`D:\Miuzarte\Downloads`, `bhxqtd_2.6.0_20241012_105217_37c02.apk`))
 	fmt.Println(filepath.Join(`D:\Miuzarte\Downloads`, `bhxqtd_2.6.0_20241012_105217_37c02.apk`))
 }
+
+func TestMoveFileKeepsSourceOnError(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "a.part"), filepath.Join(dir, "b")
+	os.WriteFile(src, []byte("data"), 0644)
+	os.MkdirAll(filepath.Join(dst, "x"), 0755) // 非空目录, 不是跨文件系统的错误
+	if err := moveFile(src, dst); err == nil {
+		t.Fatal("moving onto a directory should fail")
+	}
+	if b, err := os.ReadFile(src); err != nil || string(b) != "data" {
+		t.Fatalf("source lost: %v", err)
+	}
+	if err := moveFile(src, filepath.Join(dir, "c")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FtpSource ftp:// 与 ftps:// (隐式 TLS, 同 curl),
+// 每个块使用独立的控制连接, 以 REST 指定偏移后 RETR
+type FtpSource struct {
+	addr        string
+	host        string
+	implicitTLS bool
+	user        string
+	pass        string
+	path        string
+
+	tlsConfig *tls.Config
+	gotConn   func() // 新建控制连接时调用, 用于统计连接数
+
+	mu     sync.Mutex
+	idle   []*ftpConn // 传输完成的控制连接, 供后续块复用
+	closed bool
+}
+
+func NewFtpSource(u *url.URL, auth *Auth) *FtpSource {
+	s := &FtpSource{
+		host:        u.Hostname(),
+		implicitTLS: u.Scheme == "ftps",
+		user:        "anonymous",
+		pass:        "anonymous@",
+		path:        strings.TrimPrefix(u.Path, "/"), // 同 curl, 相对于登录目录
+	}
+	port := u.Port()
+	if port == "" {
+		port = "21"
+		if s.implicitTLS {
+			port = "990"
+		}
+	}
+	s.addr = net.JoinHostPort(s.host, port)
+
+	switch {
+	case u.User != nil:
+		s.user = u.User.Username()
+		s.pass, _ = u.User.Password()
+	case auth != nil && auth.User != "":
+		s.user, s.pass = auth.User, auth.Password
+	}
+
+	if s.implicitTLS {
+		s.tlsConfig = tlsConfig.Clone()
+		if s.tlsConfig == nil {
+			s.tlsConfig = &tls.Config{}
+		}
+		s.tlsConfig.ServerName = s.host
+		s.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0) // 数据连接复用会话
+	}
+	return s
+}
+
+type ftpConn struct {
+	conn net.Conn
+	tp   *textproto.Conn
+}
+
+// cmd 发送命令并读取响应, expect 为 0 时不检查响应码
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	id, err := c.tp.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.tp.StartResponse(id)
+	defer c.tp.EndResponse(id)
+	return c.tp.ReadResponse(expect)
+}
+
+func (c *ftpConn) Close() error {
+	return c.conn.Close()
+}
+
+func (s *FtpSource) dial(ctx context.Context) (*ftpConn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.implicitTLS {
+		conn = tls.Client(conn, s.tlsConfig)
+	}
+	if s.gotConn != nil {
+		s.gotConn()
+	}
+	c := &ftpConn{conn: conn, tp: textproto.NewConn(conn)}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = func() error {
+		if _, _, err := c.tp.ReadResponse(220); err != nil {
+			return err
+		}
+		code, msg, err := c.cmd(0, "USER %s", s.user)
+		switch {
+		case err != nil:
+			return err
+		case code == 331:
+			if _, _, err = c.cmd(230, "PASS %s", s.pass); err != nil {
+				return err
+			}
+		case code != 230:
+			return &textproto.Error{Code: code, Msg: msg}
+		}
+		if s.implicitTLS {
+			if _, _, err = c.cmd(200, "PBSZ 0"); err != nil {
+				return err
+			}
+			if _, _, err = c.cmd(200, "PROT P"); err != nil {
+				return err
+			}
+		}
+		_, _, err = c.cmd(200, "TYPE I")
+		return err
+	}()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ftp %s: %w", s.addr, err)
+	}
+	return c, nil
+}
+
+// get 复用空闲控制连接
+func (s *FtpSource) get(ctx context.Context) (*ftpConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+	return s.dial(ctx)
+}
+
+func (s *FtpSource) put(c *ftpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func (s *FtpSource) Stat(ctx context.Context) (info sourceInfo, err error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		} else {
+			s.put(c)
+		}
+	}()
+
+	info.name = path.Base(s.path)
+	info.size = -1
+	code, msg, err := c.cmd(0, "SIZE %s", s.path)
+	switch {
+	case err != nil:
+		return
+	case code == 213:
+		if info.size, err = strconv.Atoi(strings.TrimSpace(msg)); err != nil {
+			return info, fmt.Errorf("ftp: bad SIZE reply %q", msg)
+		}
+	case code == 550:
+		return info, fmt.Errorf("ftp: %s: %s", s.path, msg)
+	}
+
+	if code, msg, err = c.cmd(0, "MDTM %s", s.path); err != nil {
+		return
+	}
+	if code == 213 && len(msg) >= 14 {
+		info.modTime, _ = time.Parse("20060102150405", msg[:14])
+	}
+
+	if code, _, err = c.cmd(0, "REST 0"); err != nil {
+		return
+	}
+	info.acceptRanges = code == 350 && info.size > 0
+	return
+}
+
+// openData EPSV, 不支持时退化为 PASV, 均连接控制连接的主机
+func (s *FtpSource) openData(ctx context.Context, c *ftpConn) (net.Conn, error) {
+	var port int
+	code, msg, err := c.cmd(0, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	if code == 229 {
+		// Entering Extended Passive Mode (|||6446|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start+4 {
+			return nil, fmt.Errorf("ftp: bad EPSV reply %q", msg)
+		}
+		if port, err = strconv.Atoi(msg[start+4 : end]); err != nil {
+			return nil, fmt.Errorf("ftp: bad EPSV reply %q", msg)
+		}
+	} else {
+		if _, msg, err = c.cmd(227, "PASV"); err != nil {
+			return nil, err
+		}
+		// Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("ftp: bad PASV reply %q", msg)
+		}
+		f := strings.Split(msg[start+1:end], ",")
+		if len(f) != 6 {
+			return nil, fmt.Errorf("ftp: bad PASV reply %q", msg)
+		}
+		p1, err1 := strconv.Atoi(f[4])
+		p2, err2 := strconv.Atoi(f[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("ftp: bad PASV reply %q", msg)
+		}
+		port = p1<<8 | p2
+	}
+
+	d := &net.Dialer{Timeout: dialTimeout}
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(s.host, strconv.Itoa(port)))
+}
+
+func (s *FtpSource) OpenRange(ctx context.Context, start, end int) (io.ReadCloser, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := func() (net.Conn, error) {
+		data, err := s.openData(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if start > 0 {
+			if _, _, err = c.cmd(350, "REST %d", start); err != nil {
+				data.Close()
+				return nil, err
+			}
+		}
+		if _, _, err = c.cmd(1, "RETR %s", s.path); err != nil {
+			data.Close()
+			return nil, err
+		}
+		if s.implicitTLS {
+			data = tls.Client(data, s.tlsConfig)
+		}
+		return data, nil
+	}()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	r := &ftpReader{s: s, c: c, data: data, remaining: -1}
+	if end >= 0 {
+		r.remaining = end - start + 1
+	}
+	r.stop = context.AfterFunc(ctx, func() { data.Close() }) // 取消时中断读取
+	return r, nil
+}
+
+func (s *FtpSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, c := range s.idle {
+		c.cmd(0, "QUIT")
+		c.Close()
+	}
+	s.idle = nil
+	return nil
+}
+
+// ftpReader 读到块结尾为止,
+// 恰好读完整个文件时控制连接回到池中, 提前结束则连同控制连接一起关闭
+type ftpReader struct {
+	s         *FtpSource
+	c         *ftpConn
+	data      net.Conn
+	remaining int // -1 为读到 EOF
+	eof       bool
+	stop      func() bool
+}
+
+func (r *ftpReader) Read(p []byte) (n int, err error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if r.remaining > 0 && len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err = r.data.Read(p)
+	if r.remaining > 0 {
+		r.remaining -= n
+	}
+	if err == io.EOF {
+		r.eof = true
+		if r.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return
+}
+
+func (r *ftpReader) Close() error {
+	r.stop()
+	if !r.eof && r.remaining == 0 { // 块刚好结束在文件末尾时, 数据连接随后会 EOF
+		var buf [1]byte
+		r.data.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := r.data.Read(buf[:])
+		r.eof = errors.Is(err, io.EOF)
+	}
+	r.data.Close()
+
+	if r.eof {
+		r.c.conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		_, _, err := r.c.tp.ReadResponse(2) // 226 Transfer complete
+		r.c.conn.SetReadDeadline(time.Time{})
+		if err == nil {
+			r.s.put(r.c)
+			return nil
+		}
+	}
+	return r.c.Close()
+}
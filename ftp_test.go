@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ftpTestServer 只实现下载所需命令的 FTP 服务器
+type ftpTestServer struct {
+	t         *testing.T
+	ln        net.Listener
+	user      string
+	pass      string
+	files     map[string][]byte
+	modTime   time.Time
+	tls       *tls.Config // 隐式 TLS
+	noEPSV    bool
+	active    atomic.Int32
+	maxActive atomic.Int32
+	retrs     atomic.Int32
+}
+
+func newFtpTestServer(t *testing.T, user, pass string, files map[string][]byte, tlsConf *tls.Config) *ftpTestServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConf != nil {
+		ln = tls.NewListener(ln, tlsConf)
+	}
+	s := &ftpTestServer{t: t, ln: ln, user: user, pass: pass, files: files, tls: tlsConf,
+		modTime: time.Date(2024, 10, 2, 11, 33, 1, 0, time.UTC)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *ftpTestServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *ftpTestServer) serve(c net.Conn) {
+	defer c.Close()
+	n := s.active.Add(1)
+	defer s.active.Add(-1)
+	for {
+		m := s.maxActive.Load()
+		if n <= m || s.maxActive.CompareAndSwap(m, n) {
+			break
+		}
+	}
+
+	r := bufio.NewReader(c)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(c, format+"\r\n", args...)
+	}
+	reply("220 test server ready")
+
+	var (
+		user     string
+		loggedIn bool
+		rest     int
+		pasv     net.Listener
+	)
+	defer func() {
+		if pasv != nil {
+			pasv.Close()
+		}
+	}()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !loggedIn && cmd != "USER" && cmd != "PASS" && cmd != "QUIT" {
+			reply("530 not logged in")
+			continue
+		}
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			user = arg
+			reply("331 password required")
+		case "PASS":
+			if user != s.user || arg != s.pass {
+				reply("530 login incorrect")
+				continue
+			}
+			loggedIn = true
+			reply("230 logged in")
+		case "TYPE", "PBSZ", "PROT":
+			reply("200 ok")
+		case "SIZE":
+			data, ok := s.files[arg]
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(data))
+		case "MDTM":
+			reply("213 %s", s.modTime.Format("20060102150405"))
+		case "REST":
+			rest, _ = strconv.Atoi(arg)
+			reply("350 restarting at %d", rest)
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && s.noEPSV {
+				reply("502 not implemented")
+				continue
+			}
+			if pasv != nil {
+				pasv.Close()
+			}
+			if pasv, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 %v", err)
+				continue
+			}
+			if s.tls != nil {
+				pasv = tls.NewListener(pasv, s.tls)
+			}
+			port := pasv.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "RETR":
+			data, ok := s.files[arg]
+			if !ok || pasv == nil {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 opening data connection")
+			s.retrs.Add(1)
+			dc, err := pasv.Accept()
+			pasv.Close()
+			pasv = nil
+			if err != nil {
+				reply("425 %v", err)
+				continue
+			}
+			_, err = dc.Write(data[rest:])
+			dc.Close()
+			rest = 0
+			if err != nil {
+				reply("426 transfer aborted")
+				return // 模拟不可复用的控制连接
+			}
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFtpDownload(t *testing.T) {
+	setupDownload(t, 64*1024, 4)
+
+	data := randomData(blockSize*6 + 321)
+	srv := newFtpTestServer(t, "alice", "secret", map[string][]byte{"pub/random.bin": data}, nil)
+
+	j := &Job{Url: "ftp://alice:secret@" + srv.addr() + "/pub/random.bin"}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "random.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+	fi, _ := os.Stat(j.filePath)
+	if !fi.ModTime().Equal(srv.modTime) {
+		t.Fatalf("mtime: %v, want %v", fi.ModTime(), srv.modTime)
+	}
+	if n := srv.retrs.Load(); n != int32(len(j.Blocks)) {
+		t.Fatalf("RETR count: %d, want %d", n, len(j.Blocks))
+	}
+	if n := srv.maxActive.Load(); n < 2 {
+		t.Fatalf("max concurrent control connections: %d, want parallel", n)
+	}
+	if strings.Contains(j.getFinalUrl(), "secret") {
+		t.Fatalf("password leaked: %s", j.getFinalUrl())
+	}
+}
+
+func TestFtpPasvAndNetrc(t *testing.T) {
+	setupDownload(t, 64*1024, 0)
+
+	data := randomData(blockSize*2 + 7)
+	srv := newFtpTestServer(t, "bob", "hunter2", map[string][]byte{"file.bin": data}, nil)
+	srv.noEPSV = true
+	host, _, _ := net.SplitHostPort(srv.addr())
+	useNetrc(t, writeNetrc(t, "machine "+host+" login bob password hunter2\n"))
+
+	j := &Job{Url: "ftp://" + srv.addr() + "/file.bin"}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+}
+
+func TestFtpsDownload(t *testing.T) {
+	setupDownload(t, 64*1024, 0)
+
+	https := httptest.NewTLSServer(nil)
+	https.Close()
+	serverConf := &tls.Config{Certificates: https.TLS.Certificates}
+	if err := useTLS(t, TLSOptions{Insecure: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomData(blockSize*3 + 1)
+	srv := newFtpTestServer(t, "anonymous", "anonymous@", map[string][]byte{"secure.bin": data}, serverConf)
+
+	j := &Job{Url: "ftps://" + srv.addr() + "/secure.bin"}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "secure.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// m3u8 解析后的播放列表, 主播放列表只有 variants
+type m3u8 struct {
+	variants []variant
+	segments []*segment
+	audio    bool // 存在独立的音轨
+	endList  bool // 点播, 否则为直播
+	fmp4     bool // EXT-X-MAP, 输出 .mp4
+}
+
+func (v variant) String() string {
+	if v.height > 0 {
+		return fmt.Sprintf("%dx%d %d kbps", v.width, v.height, v.bandwidth/1000)
+	}
+	return fmt.Sprintf("%d kbps", v.bandwidth/1000)
+}
+
+// loadHLS 主播放列表按 streamVariant 选择码率后读取媒体播放列表
+func (j *Job) loadHLS(ctx context.Context, rawUrl string) ([]*segment, string, error) {
+	body, base, err := j.fetchPlaylist(ctx, rawUrl)
+	if err != nil {
+		return nil, "", err
+	}
+	pl, err := parseM3U8(body, base)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(pl.variants) > 0 {
+		i, err := pickVariant(pl.variants, streamVariant)
+		if err != nil {
+			return nil, "", err
+		}
+		v := pl.variants[i]
+		log.Infof("Variant: %s of %d", v, len(pl.variants))
+		if pl.audio {
+			log.Warn("Separate audio renditions are not downloaded")
+		}
+		if body, base, err = j.fetchPlaylist(ctx, v.url); err != nil {
+			return nil, "", err
+		}
+		if pl, err = parseM3U8(body, base); err != nil {
+			return nil, "", err
+		}
+		if len(pl.variants) > 0 {
+			return nil, "", errors.New("m3u8: nested master playlist")
+		}
+	}
+
+	if !pl.endList {
+		log.Warn("Live playlist, only downloading the segments currently listed")
+	}
+	if pl.fmp4 {
+		j.contentType = "video/mp4"
+		return pl.segments, ".mp4", nil
+	}
+	j.contentType = "video/mp2t"
+	return pl.segments, ".ts", nil
+}
+
+// parseM3U8 RFC 8216, 忽略与下载无关的标签
+func parseM3U8(data []byte, base *url.URL) (*m3u8, error) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if strings.TrimSpace(strings.TrimPrefix(lines[0], "\ufeff")) != "#EXTM3U" {
+		return nil, errors.New("m3u8: missing #EXTM3U header")
+	}
+
+	pl := &m3u8{}
+	var (
+		seq       int // 当前分段的序号, 用作默认 IV
+		key       *segmentKey
+		iv        []byte
+		stream    *variant // 等待 URI 的 EXT-X-STREAM-INF
+		byteRange string
+		lastUrl   string // 省略偏移的 BYTERANGE 接着同一地址的上一段
+		lastEnd   = -1
+		lastMap   string
+	)
+	for n, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		tag, value, _ := strings.Cut(line, ":")
+		lineErr := func(err error) error {
+			return fmt.Errorf("m3u8 line %d: %w", n+2, err)
+		}
+
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			attrs := parseAuthParams(value)
+			stream = &variant{}
+			stream.bandwidth, _ = strconv.Atoi(attrs["bandwidth"])
+			if w, h, ok := strings.Cut(attrs["resolution"], "x"); ok {
+				stream.width, _ = strconv.Atoi(w)
+				stream.height, _ = strconv.Atoi(h)
+			}
+		case tag == "#EXT-X-MEDIA":
+			attrs := parseAuthParams(value)
+			if attrs["type"] == "AUDIO" && attrs["uri"] != "" {
+				pl.audio = true
+			}
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			seq, _ = strconv.Atoi(value)
+		case tag == "#EXT-X-KEY":
+			attrs := parseAuthParams(value)
+			switch attrs["method"] {
+			case "NONE":
+				key, iv = nil, nil
+			case "AES-128":
+				ref, err := resolveRef(base, attrs["uri"])
+				if err != nil || attrs["uri"] == "" {
+					return nil, lineErr(errors.New("AES-128 key without URI"))
+				}
+				key, iv = &segmentKey{url: ref}, nil
+				if s := attrs["iv"]; s != "" {
+					b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(s), "0x"))
+					if err != nil || len(b) != 16 {
+						return nil, lineErr(fmt.Errorf("bad IV %q", s))
+					}
+					iv = b
+				}
+			default:
+				return nil, lineErr(fmt.Errorf("unsupported encryption method %q", attrs["method"]))
+			}
+		case tag == "#EXT-X-BYTERANGE":
+			byteRange = value
+		case tag == "#EXT-X-MAP":
+			attrs := parseAuthParams(value)
+			ref, err := resolveRef(base, attrs["uri"])
+			if err != nil {
+				return nil, lineErr(err)
+			}
+			pl.fmp4 = true
+			if ref+attrs["byterange"] == lastMap { // 只在初始化段变化时写入
+				continue
+			}
+			lastMap = ref + attrs["byterange"]
+			seg := &segment{url: ref, end: -1}
+			if attrs["byterange"] != "" {
+				if seg.start, seg.end, err = parseByteRange(attrs["byterange"], 0); err != nil {
+					return nil, lineErr(err)
+				}
+			}
+			if key != nil && iv != nil {
+				seg.key, seg.iv = key, iv
+			}
+			pl.segments = append(pl.segments, seg)
+		case tag == "#EXT-X-ENDLIST":
+			pl.endList = true
+		case strings.HasPrefix(line, "#"):
+		default:
+			ref, err := resolveRef(base, line)
+			if err != nil {
+				return nil, lineErr(err)
+			}
+			if stream != nil {
+				stream.url = ref
+				pl.variants = append(pl.variants, *stream)
+				stream = nil
+				continue
+			}
+
+			seg := &segment{url: ref, end: -1}
+			if byteRange != "" {
+				next := 0
+				if ref == lastUrl {
+					next = lastEnd + 1
+				}
+				if seg.start, seg.end, err = parseByteRange(byteRange, next); err != nil {
+					return nil, lineErr(err)
+				}
+				lastUrl, lastEnd = ref, seg.end
+				byteRange = ""
+			}
+			if key != nil {
+				seg.key, seg.iv = key, iv
+				if iv == nil {
+					seg.iv = make([]byte, 16)
+					binary.BigEndian.PutUint64(seg.iv[8:], uint64(seq))
+				}
+			}
+			pl.segments = append(pl.segments, seg)
+			seq++
+		}
+	}
+	return pl, nil
+}
+
+// parseByteRange "n[@o]", 省略偏移时从 next 开始
+func parseByteRange(s string, next int) (start, end int, err error) {
+	ns, off, hasOffset := strings.Cut(strings.Trim(s, `"`), "@")
+	n, err := strconv.Atoi(ns)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("bad byte range %q", s)
+	}
+	start = next
+	if hasOffset {
+		if start, err = strconv.Atoi(off); err != nil {
+			return 0, 0, fmt.Errorf("bad byte range %q", s)
+		}
+	}
+	return start, start + n - 1, nil
+}
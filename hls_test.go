@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// encryptSegment AES-128-CBC + PKCS#7
+func encryptSegment(t *testing.T, key, iv, data []byte) []byte {
+	t.Helper()
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	out := append(bytes.Clone(data), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(c, iv).CryptBlocks(out, out)
+	return out
+}
+
+func sequenceIV(seq int) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+func TestParseM3U8(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/talk/720p/index.m3u8")
+	pl, err := parseM3U8([]byte(`#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="100@0"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@100
+media.mp4
+#EXTINF:4,
+#EXT-X-BYTERANGE:500
+media.mp4
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/k1"
+#EXTINF:4,
+../seg9.ts
+#EXT-X-ENDLIST
+`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []segment{
+		{url: "https://cdn.example.com/talk/720p/init.mp4", start: 0, end: 99},
+		{url: "https://cdn.example.com/talk/720p/media.mp4", start: 100, end: 1099},
+		{url: "https://cdn.example.com/talk/720p/media.mp4", start: 1100, end: 1599},
+		{url: "https://cdn.example.com/talk/seg9.ts", start: 0, end: -1},
+	}
+	if len(pl.segments) != len(want) || !pl.endList || !pl.fmp4 {
+		t.Fatalf("segments: %d, endList: %v, fmp4: %v", len(pl.segments), pl.endList, pl.fmp4)
+	}
+	for i, w := range want {
+		s := pl.segments[i]
+		if s.url != w.url || s.start != w.start || s.end != w.end {
+			t.Errorf("segment %d: %s %d-%d, want %s %d-%d", i, s.url, s.start, s.end, w.url, w.start, w.end)
+		}
+	}
+	last := pl.segments[3]
+	if last.key == nil || last.key.url != "https://cdn.example.com/keys/k1" || !bytes.Equal(last.iv, sequenceIV(9)) {
+		t.Fatalf("key: %+v, iv: %x", last.key, last.iv)
+	}
+
+	if _, err = parseM3U8([]byte("#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"k\"\n"), base); err == nil {
+		t.Fatal("SAMPLE-AES should be rejected")
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	vs := []variant{
+		{bandwidth: 800000, height: 480},
+		{bandwidth: 5000000, height: 1080},
+		{bandwidth: 2500000, height: 720},
+	}
+	for want, i := range map[string]int{"": 1, "best": 1, "worst": 0, "720p": 2, "3000000": 2, "1": 0} {
+		got, err := pickVariant(vs, want)
+		if err != nil || got != i {
+			t.Errorf("%q: %d, %v, want %d", want, got, err, i)
+		}
+	}
+	if _, err := pickVariant(vs, "360p"); err == nil {
+		t.Error("360p should not match")
+	}
+}
+
+func TestHLSDownload(t *testing.T) {
+	setupDownload(t, 0, 4)
+
+	key := []byte("0123456789abcdef")
+	explicitIV := bytes.Repeat([]byte{0x42}, 16)
+	var plain [][]byte
+	files := map[string][]byte{
+		"/keys/k1":        key,
+		"/low/index.m3u8": []byte("#EXTM3U\n#EXTINF:4,\nseg0.ts\n#EXT-X-ENDLIST\n"),
+		"/low/seg0.ts":    []byte("low quality"),
+	}
+	media := &strings.Builder{}
+	media.WriteString("#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:3\n")
+	for i := 0; i < 8; i++ {
+		data := randomData(10000 + i)
+		plain = append(plain, data)
+		name := fmt.Sprintf("seg%d.ts", i)
+		switch i {
+		case 2: // 省略 IV, 使用序号
+			media.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/k1\"\n")
+		case 4:
+			media.WriteString("#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/k1\",IV=0x42424242424242424242424242424242\n")
+		case 5:
+			media.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+		}
+		switch i {
+		case 2, 3:
+			files["/high/"+name] = encryptSegment(t, key, sequenceIV(3+i), data)
+		case 4:
+			files["/high/"+name] = encryptSegment(t, key, explicitIV, data)
+		default:
+			files["/high/"+name] = data
+		}
+		fmt.Fprintf(media, "#EXTINF:4,\n%s\n", name)
+	}
+	media.WriteString("#EXT-X-ENDLIST\n")
+	files["/high/index.m3u8"] = []byte(media.String())
+	files["/talk"] = []byte(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"
+high/index.m3u8
+`)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/talk" {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/talk"} // 无扩展名, 按 Content-Type 识别
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "index.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.Join(plain, nil)) {
+		t.Fatal("content mismatch")
+	}
+	if j.src != SRC_HLS || len(j.Blocks) != 8 {
+		t.Fatalf("src: %d, blocks: %d", j.src, len(j.Blocks))
+	}
+}
+
+func TestHLSMissingSegmentKeepsNothing(t *testing.T) {
+	setupDownload(t, 0, 0)
+	defer func(n int) { autoRetry = n }(autoRetry)
+	autoRetry = 1
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXTINF:4,\na.ts\n#EXTINF:4,\nmissing.ts\n#EXT-X-ENDLIST\n"))
+		case "/a.ts":
+			w.Write([]byte("segment"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/v.m3u8"}
+	if err := j.init(); err != nil {
+		t.Fatal(err)
+	}
+	j.splitBlocks()
+	j.createFile()
+	if err := j.DownloadMultiThread(&sync.WaitGroup{}); err == nil {
+		t.Fatal("missing segment should fail")
+	}
+	j.Clean()
+	entries, _ := os.ReadDir(DownloadsFolder)
+	if len(entries) != 0 {
+		t.Fatalf("incomplete stream should not be kept: %v", entries)
+	}
+}
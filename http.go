@@ -1,34 +1,235 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	dialTimeout   = 30 * time.Second // 建立 TCP 连接
+	tlsTimeout    = 10 * time.Second // TLS 握手
+	headerTimeout = 30 * time.Second // 等待响应头
+	idleTimeout   = 90 * time.Second // 空闲连接保留
+	stallTimeout  = 30 * time.Second // 读取无进展, 0 为不检测
 )
 
+var ErrStalled = errors.New("read stalled")
+
 type Transport struct {
 	Transport http.RoundTripper
 }
 
-// RoundTrip 全局设置 Header
+// RoundTrip 选择代理
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// req.Header = Header // range被覆盖
-	for k, v := range Header {
-		req.Header[k] = v
+	p, err := Proxy.For(req)
+	if err != nil {
+		return nil, err
 	}
-
-	// 设置代理
-	if ProxyURL != nil {
-		proxy := http.ProxyURL(ProxyURL)
-		transport := t.Transport.(*http.Transport)
-		transport.Proxy = proxy
+	if p != nil {
+		req = req.WithContext(withProxy(req.Context(), p))
 	}
 
 	return t.Transport.RoundTrip(req)
 }
 
+// httpVersion 协议选择: "" 自动协商, "1.1" 每个线程独立 TCP 连接, "2" 单连接多路复用, "3" QUIC
+var httpVersion = ""
+
 func NewClient() *http.Client {
+	var rt http.RoundTripper = newTransport()
+	if httpVersion == "3" {
+		rt = newHTTP3Transport()
+	}
 	return &http.Client{
 		Transport: &Transport{
-			Transport: http.DefaultTransport,
+			Transport: rt,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// newRequest 带任务 Header 的请求, 统计新建的连接
+func (j *Job) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				j.conns.Add(1)
+			}
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	header := j.Header
+	if header == nil {
+		header = DefaultHeader
+	}
+	for k, v := range header {
+		req.Header[k] = slices.Clone(v)
+	}
+	if hostConfig != nil {
+		hostConfig.hostHeader(req.URL.Hostname()).Apply(req.Header)
+		req = req.WithContext(context.WithValue(req.Context(), baseHeaderCtxKey{}, header))
+	}
+	return req, nil
+}
+
+// do 发送请求, 遇到 401 质询时带凭据重试一次
+func (j *Job) do(req *http.Request) (*http.Response, error) {
+	auth := j.authFor(req.URL, false)
+	auth.Apply(req)
+	if j.s3 != nil {
+		j.s3.sign(req)
+	}
+	resp, err := Client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// 重定向后质询来自最终主机
+	if auth == nil || !strings.EqualFold(auth.Host, resp.Request.URL.Host) {
+		auth = j.authFor(resp.Request.URL, true)
+	}
+	if !auth.Challenge(resp) {
+		return resp, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry, err := j.newRequest(req.Context(), req.Method, resp.Request.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range resp.Request.Header { // 最后一跳的头, 已按主机换过
+		if k != "Authorization" {
+			retry.Header[k] = v
+		}
+	}
+	auth.Apply(retry)
+	return Client.Do(retry)
+}
+
+// authFor 主机对应的凭据, 任务凭据优先, 其次 .netrc
+func (j *Job) authFor(u *url.URL, challenged bool) *Auth {
+	if j.Auth != nil && strings.EqualFold(j.Auth.Host, u.Host) {
+		return j.Auth
+	}
+	return netrcAuth(u, challenged)
+}
+
+var maxRedirects = 10 // 最大重定向次数, 0 为不跟随
+
+type redirectsCtxKey struct{}
+
+type baseHeaderCtxKey struct{} // newRequest 添加主机段的头之前的 Header
+
+// withRedirectLog 记录请求经过的重定向
+func withRedirectLog(ctx context.Context, redirects *[]string) context.Context {
+	return context.WithValue(ctx, redirectsCtxKey{}, redirects)
+}
+
+// checkRedirect 限制次数并记录重定向链, 跨主机时不转发凭据
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	prev := via[len(via)-1]
+	status := 0
+	if req.Response != nil {
+		status = req.Response.StatusCode
+	}
+	log.Debugf("Redirect %d/%d (%d): %s -> %s", len(via), maxRedirects, status, prev.URL.Redacted(), req.URL.Redacted())
+	if redirects, ok := req.Context().Value(redirectsCtxKey{}).(*[]string); ok {
+		*redirects = append(*redirects, req.URL.String())
+	}
+
+	// 每一跳的头都复制自第一个请求
+	base, rehost := req.Context().Value(baseHeaderCtxKey{}).(http.Header)
+	rehost = rehost && hostConfig != nil && !strings.EqualFold(req.URL.Hostname(), via[0].URL.Hostname())
+	if rehost {
+		hostConfig.rehost(req, via[0].URL.Hostname(), base)
+	}
+	if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		req.Header.Del("Authorization")
+		req.Header.Del("Cookie") // -H 给出的, Jar 中的按域名另行添加
+	}
+	if rehost {
+		hostConfig.hostHeader(req.URL.Hostname()).Apply(req.Header)
+	}
+	return nil
+}
+
+// newTransport 独立的 Transport, 每主机连接数按 threadNum 与 -jobs 设置, 块之间复用连接
+func newTransport() *http.Transport {
+	perHost := max(parallelJobs, 1) * (threadNum + 1) // Runner 的任务共用 Client, 多出的给 HEAD 等请求
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy: httpProxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if p := proxyFromContext(ctx); p != nil && isSocks(p) {
+				return dialSocks5(ctx, dialer, p, network, addr)
+			}
+			return dialer.DialContext(ctx, network, addr)
 		},
+		TLSClientConfig:       tlsConfig.Clone(),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   perHost,
+		MaxConnsPerHost:       perHost,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   tlsTimeout,
+		ResponseHeaderTimeout: headerTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	switch httpVersion {
+	case "1.1":
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{} // 非 nil 时不启用 HTTP/2
+	}
+	return t
+}
+
+// stallReader 超过 timeout 没有读到数据时调用 cancel(ErrStalled)
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelCauseFunc) *stallReader {
+	s := &stallReader{r: r, timeout: timeout}
+	if timeout > 0 {
+		s.timer = time.AfterFunc(timeout, func() { cancel(ErrStalled) })
+	}
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (n int, err error) {
+	n, err = s.r.Read(p)
+	if n > 0 && s.timer != nil {
+		s.timer.Reset(s.timeout)
+	}
+	return
+}
+
+func (s *stallReader) Stop() {
+	if s.timer != nil {
+		s.timer.Stop()
 	}
 }
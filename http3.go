@@ -0,0 +1,19 @@
+//go:build http3
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+const http3Supported = true
+
+// newHTTP3Transport 实验性的 HTTP/3 (QUIC), 不支持代理
+func newHTTP3Transport() http.RoundTripper {
+	return &http3.Transport{
+		TLSClientConfig:    tlsConfig.Clone(),
+		DisableCompression: true, // 保证 Content-Length 与 Range 对应原始字节
+	}
+}
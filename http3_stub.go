@@ -0,0 +1,14 @@
+//go:build !http3
+
+package main
+
+import (
+	"net/http"
+)
+
+const http3Supported = false
+
+// newHTTP3Transport 需要以 -tags http3 编译
+func newHTTP3Transport() http.RoundTripper {
+	return nil
+}
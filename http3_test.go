@@ -0,0 +1,57 @@
+//go:build http3
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3(t *testing.T) {
+	// 借用 httptest 的自签名证书
+	tlsSrv := httptest.NewUnstartedServer(nil)
+	tlsSrv.StartTLS()
+	cert := tlsSrv.TLS.Certificates[0]
+	tlsSrv.Close()
+
+	data := randomData(1024 * 64)
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http3.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "random.bin", time.Time{}, bytes.NewReader(data))
+		}),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+	go srv.Serve(udp)
+	defer srv.Close()
+
+	defer func(v string) { httpVersion = v }(httpVersion)
+	httpVersion = "3"
+	useTLS(t, TLSOptions{Insecure: true})
+	showThreadProgressBar = false
+
+	j := &Job{Url: "https://" + udp.LocalAddr().String() + "/random.bin"}
+	if err := j.init(); err != nil {
+		t.Fatal(err)
+	}
+	if j.proto != "HTTP/3.0" || j.size != len(data) {
+		t.Fatalf("proto: %s, size: %d", j.proto, j.size)
+	}
+	block := &Block{start: 1024, end: 2047}
+	if err := j.downloadBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block.Bytes(), data[1024:2048]) {
+		t.Fatal("content mismatch")
+	}
+}
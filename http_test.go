@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStallTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(make([]byte, 10))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // 卡住
+	}))
+	defer srv.Close()
+
+	defer func(d time.Duration) { stallTimeout = d }(stallTimeout)
+	stallTimeout = 200 * time.Millisecond
+	showThreadProgressBar = false
+
+	j := &Job{finalUrl: srv.URL}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	defer j.cancel()
+
+	start := time.Now()
+	err := j.downloadBlock(&Block{start: 0, end: 99})
+	if !errors.Is(err, ErrStalled) {
+		t.Fatalf("err: %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("stall detected after %v", d)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	var conns atomic.Int32
+	data := randomData(1024 * 64)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "random.bin", time.Now(), bytes.NewReader(data))
+	}))
+	srv.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	showThreadProgressBar = false
+	Client = NewClient()
+	j := &Job{finalUrl: srv.URL + "/random.bin"}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	defer j.cancel()
+
+	for i := 0; i < 8; i++ {
+		block := &Block{index: i, start: i * 1024 * 8, end: (i+1)*1024*8 - 1}
+		if err := j.downloadBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("%d connections for 8 sequential blocks, want 1", n)
+	}
+}
+
+func TestHttpVersion(t *testing.T) {
+	data := randomData(1024 * 64)
+	var inflight atomic.Int32
+	barrier := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" { // 等 4 个块都到达, 保证同时在途
+			if inflight.Add(1) == 4 {
+				close(barrier)
+			}
+			select {
+			case <-barrier:
+			case <-time.After(2 * time.Second):
+			}
+		}
+		http.ServeContent(w, r, "random.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	defer func(v string) { httpVersion = v }(httpVersion)
+	useTLS(t, TLSOptions{Insecure: true})
+	showThreadProgressBar = false
+
+	for _, c := range []struct {
+		version string
+		proto   string
+		conns   int32
+	}{
+		{"1.1", "HTTP/1.1", 4},
+		{"2", "HTTP/2.0", 1},
+	} {
+		httpVersion = c.version
+		Client = NewClient()
+		inflight.Store(0)
+		barrier = make(chan struct{})
+
+		j := &Job{Url: srv.URL + "/random.bin"}
+		if err := j.init(); err != nil {
+			t.Fatal(err)
+		}
+		if j.proto != c.proto {
+			t.Errorf("-http %s: proto %s, want %s", c.version, j.proto, c.proto)
+		}
+
+		// 4 个块同时下载
+		start := make(chan struct{})
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			go func(i int) {
+				<-start
+				errs <- j.downloadBlock(&Block{index: i, start: i * 1024 * 16, end: (i+1)*1024*16 - 1})
+			}(i)
+		}
+		close(start)
+		for i := 0; i < 4; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		// HEAD 的连接空闲后会被某个块复用
+		if n := j.conns.Load(); n != c.conns {
+			t.Errorf("-http %s: %d connections, want %d", c.version, n, c.conns)
+		}
+		if !strings.Contains(j.String(), "proto: "+c.proto) {
+			t.Errorf("String() = %s", j)
+		}
+	}
+}
+
+func TestTransportConnsScaleWithJobs(t *testing.T) {
+	defer func(threads, jobs int) { threadNum, parallelJobs = threads, jobs }(threadNum, parallelJobs)
+	threadNum, parallelJobs = 6, 4
+	if n := newTransport().MaxConnsPerHost; n != 28 {
+		t.Fatalf("MaxConnsPerHost: %d, want 28", n)
+	}
+	parallelJobs = 0
+	if n := newTransport().MaxConnsPerHost; n != 7 {
+		t.Fatalf("MaxConnsPerHost: %d, want 7", n)
+	}
+}
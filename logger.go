@@ -2,24 +2,177 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Miuzarte/ANSIFmt"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
 )
 
-type LogFormat struct{}
+// LogFormat 单行文本日志, Color 为 false 时不输出 ANSI 转义
+type LogFormat struct {
+	Color bool
+}
 
 func (f *LogFormat) Format(entry *log.Entry) ([]byte, error) {
 	buf := new(bytes.Buffer)
-	buf.WriteString(logLevelBanner[entry.Level])
+	if f.Color {
+		buf.WriteString(logLevelBanner[entry.Level])
+	} else {
+		fmt.Fprintf(buf, "[%.4s]", strings.ToUpper(entry.Level.String()))
+	}
 	buf.WriteString(entry.Time.Format("[01/02|15:04:05] "))
 	buf.WriteString(entry.Message)
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		field := fmt.Sprintf(" %s=%v", k, entry.Data[k])
+		if f.Color {
+			field = logFieldStyle.Sprint(field)
+		}
+		buf.WriteString(field)
+	}
 	buf.WriteString("\n")
 
 	return buf.Bytes(), nil
 }
 
 var (
+	logFile     = ""          // -log-file, 为空时输出到 stderr
+	logFormat   = "text"      // text 或 json
+	logMaxSize  = 10 << 20    // 日志文件轮转大小
+	logBackups  = 3           // 保留的旧日志数
+	logRotation *rotateWriter // -log-file 打开的日志文件, 退出时关闭
+)
+
+// setupLogging 设置日志输出与格式, 输出不是终端时不带颜色
+func setupLogging() error {
+	var out io.Writer = os.Stderr
+	color := !plainOutput && term.IsTerminal(int(os.Stderr.Fd()))
+	if logFile != "" {
+		w, err := openRotateWriter(logFile, int64(logMaxSize), logBackups)
+		if err != nil {
+			return err
+		}
+		out, color, logRotation = w, false, w
+		log.RegisterExitHandler(closeLog) // log.Fatal 不会执行 defer
+	}
+	if !color {
+		plainOutput = true // 路径也不输出超链接
+	}
+	switch logFormat {
+	case "text":
+		log.SetFormatter(&LogFormat{Color: color})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("unknown log format: %s", logFormat)
+	}
+	log.SetOutput(out)
+	return nil
+}
+
+// closeLog 同步并关闭日志文件, 之后的日志输出到 stderr
+func closeLog() {
+	if logRotation == nil {
+		return
+	}
+	log.SetOutput(os.Stderr)
+	if err := logRotation.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, "close log file:", err)
+	}
+	logRotation = nil
+}
+
+// logger 带任务编号与主机名的日志
+func (j *Job) logger() *log.Entry {
+	fields := log.Fields{"job": j.id}
+	if u, err := url.Parse(j.Url); err == nil && u.Host != "" {
+		fields["host"] = u.Hostname()
+	}
+	return log.WithFields(fields)
+}
+
+// rotateWriter 超过 maxSize 时把 path 依次改名为 path.1 ... path.backups
+type rotateWriter struct {
+	path    string
+	maxSize int64
+	backups int
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+}
+
+func openRotateWriter(path string, maxSize int64, backups int) (*rotateWriter, error) {
+	w := &rotateWriter{path: path, maxSize: maxSize, backups: backups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) rotate() error {
+	w.f.Close()
+	if w.backups < 1 {
+		os.Remove(w.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.backups))
+		for i := w.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.f.Sync()
+	return w.f.Close()
+}
+
+var (
+	logFieldStyle  = ANSIFmt.New().Set(ANSIFmt.Style.Faint)
 	logLevelBanner = map[log.Level]string{
 		log.TraceLevel: ANSIFmt.New().
 			Set(ANSIFmt.Fore.BrightBlue).
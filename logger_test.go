@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogFormatFields(t *testing.T) {
+	e := log.WithFields(log.Fields{"status": 503, "block": 2})
+	e.Level, e.Message = log.DebugLevel, "retry"
+	b, _ := (&LogFormat{}).Format(e)
+	if !strings.HasSuffix(string(b), "retry block=2 status=503\n") || strings.Contains(string(b), "\x1b") {
+		t.Fatalf("%q", b)
+	}
+	b, _ = (&LogFormat{Color: true}).Format(e)
+	if !strings.Contains(string(b), "\x1b") {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "godown.log")
+	w, err := openRotateWriter(p, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		w.Write([]byte(s))
+	}
+	w.Close()
+	for name, want := range map[string]string{"": "dddddd\n", ".1": "cccccc\n", ".2": "bbbbbb\n"} {
+		if got, _ := os.ReadFile(p + name); string(got) != want {
+			t.Errorf("%s: %q", name, got)
+		}
+	}
+	if _, err := os.Stat(p + ".3"); !os.IsNotExist(err) {
+		t.Error("only 2 backups should be kept")
+	}
+}
+
+func TestStructuredLogFile(t *testing.T) {
+	setupDownload(t, 16*1024, 0)
+	defer func(f, format string, plain bool) {
+		logFile, logFormat, plainOutput = f, format, plain
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(&LogFormat{Color: true})
+		closeLog()
+	}(logFile, logFormat, plainOutput)
+	logFile, logFormat = filepath.Join(t.TempDir(), "godown.log"), "json"
+	if err := setupLogging(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := randomData(blockSize * 2)
+	var failed atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=16384-") && !failed.Swap(true) {
+			http.Error(w, "expired", http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "s.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/s.bin"}
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var sawStatus, sawBlock bool
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: %v", s.Text(), err)
+		}
+		if entry["job"] != float64(j.id) && entry["job"] != nil {
+			t.Fatalf("job: %v", entry)
+		}
+		if entry["status"] == float64(200) && entry["host"] == "127.0.0.1" {
+			sawStatus = true
+		}
+		if entry["block"] == float64(1) && entry["attempt"] == float64(1) && entry["status"] == "403 Forbidden" {
+			sawBlock = true
+		}
+	}
+	if !sawStatus || !sawBlock {
+		t.Fatalf("status: %v, block: %v", sawStatus, sawBlock)
+	}
+}
+
+func TestCloseLog(t *testing.T) {
+	defer func(f, format string, plain bool) {
+		logFile, logFormat, plainOutput = f, format, plain
+		log.SetFormatter(&LogFormat{Color: true})
+	}(logFile, logFormat, plainOutput)
+	logFile, logFormat = filepath.Join(t.TempDir(), "godown.log"), "text"
+	if err := setupLogging(); err != nil {
+		t.Fatal(err)
+	}
+	log.Info("before close")
+	closeLog()
+	if logRotation != nil {
+		t.Fatal("log file still open")
+	}
+	log.Info("after close") // 输出到 stderr, 不写已关闭的文件
+	closeLog()
+
+	b, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "before close") || strings.Contains(string(b), "after close") {
+		t.Fatalf("log file: %q", b)
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	DownloadsFolder string
-	ProxyURL        *url.URL
+	TempFolder      string // .part 文件目录, 需与下载目录同一文件系统
 
-	Header = http.Header{
+	// DefaultHeader 任务未指定 Header 时使用
+	DefaultHeader = http.Header{
 		"Accept":        {"*/*"},
 		"Cache-Control": {"no-cache"},
 		"Connection":    {"keep-alive"},
@@ -23,26 +26,137 @@ var (
 	Client = NewClient()
 )
 
+var (
+	checksum    *Checksum   // 仅作用于命令行给出的任务
+	jobHeader   http.Header // 命令行任务的 Header
+	jobAuth     *Auth       // 命令行任务的凭据, Host 在 main 中确定
+	writeXattrs bool        // 完成后写入扩展属性
+)
+
+// headerFlags 可重复的 -H 'Name: value'
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(s string) error {
+	if !strings.Contains(s, ":") {
+		return fmt.Errorf("invalid header %q, want 'Name: value'", s)
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+// Apply 覆盖默认值, 同名多次给出时追加, 值为空时删除该 Header (同 curl)
+func (h headerFlags) Apply(header http.Header) {
+	seen := map[string]bool{}
+	for _, s := range h {
+		k, v, _ := strings.Cut(s, ":")
+		k, v = http.CanonicalHeaderKey(strings.TrimSpace(k)), strings.TrimSpace(v)
+		switch {
+		case v == "":
+			header.Del(k)
+		case seen[k]:
+			header.Add(k, v)
+		default:
+			header.Set(k, v)
+		}
+		seen[k] = true
+	}
+}
+
 var (
 	showTotalProgressBar  bool // 显示总进度条
 	showThreadProgressBar bool // 显示线程进度条 (花里胡哨! )
 )
 
 func init() {
-	log.SetFormatter(&LogFormat{})
+	log.SetFormatter(&LogFormat{Color: true})
 	log.SetLevel(log.TraceLevel)
 }
 
 func Init() {
 	dir := flag.String("d", "", "Download directory")
-	p := flag.String("p", "", "Proxy address")
+	flag.Var(&minFreeSpace, "min-free", "Refuse to start when the download directory has less free space, K/M/G suffixes allowed, 0 to skip the check")
+	tmp := flag.String("tmp", "", "Directory for .part files, should be on the same filesystem as the download directory")
+	sum := flag.String("checksum", "", "Expected checksum, algo:hex (md5, sha1, sha256, sha512)")
+	xattr := flag.Bool("xattr", false, "Store source URL, ETag and checksum in extended attributes (Linux only)")
+	p := flag.String("p", "", "Proxy address for all requests, http(s)/socks5/socks5h with optional user:pass@, \"direct\" to ignore environment")
+	hp := flag.String("http-proxy", "", "Proxy address for http:// requests, overrides -p")
+	hsp := flag.String("https-proxy", "", "Proxy address for https:// requests, overrides -p")
+	mp := flag.String("mega-proxy", "", "Proxy address for MEGA API requests, overrides other proxies")
+	np := flag.String("no-proxy", "", "Comma separated hosts, domains or CIDRs to connect directly")
 	t := flag.Int("t", 6, "Number of threads")
-	bs := flag.Int("bs", 1024*1024*16, "Block size")
+	bs := sizeFlag(blockSize)
+	flag.Var(&bs, "bs", "Block size in bytes, K/M/G suffixes allowed, e.g. 16MiB")
+	dt := flag.Duration("dial-timeout", dialTimeout, "TCP connect timeout")
+	tt := flag.Duration("tls-timeout", tlsTimeout, "TLS handshake timeout")
+	ht := flag.Duration("header-timeout", headerTimeout, "Timeout waiting for response headers")
+	it := flag.Duration("idle-timeout", idleTimeout, "How long idle keep-alive connections are kept")
+	st := flag.Duration("stall-timeout", stallTimeout, "Abort and retry a block making no progress for this long, 0 to disable")
+	hv := flag.String("http", "", "HTTP version: 1.1 (separate connections), 2 (multiplexed), 3 (experimental QUIC), empty to negotiate")
+	mr := flag.Int("max-redirs", maxRedirects, "Maximum number of redirects to follow")
+	var headers headerFlags
+	flag.Var(&headers, "H", "Extra header 'Name: value', repeatable, empty value removes the header")
+	ua := flag.String("user-agent", "", "User-Agent header")
+	referer := flag.String("referer", "", "Referer header")
+	user := flag.String("user", "", "Credentials user:pass, Basic or Digest on challenge, only sent to the original host")
+	bearer := flag.String("bearer", "", "Bearer token, only sent to the original host")
+	netrcFile := flag.String("netrc-file", NetrcFile, "Credentials file consulted per host on 401 challenges, empty to disable")
+	flag.StringVar(&sshKeyFile, "ssh-key", "", "Private key for sftp://, defaults to ~/.ssh/id_* and ssh-agent")
+	flag.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file used to verify sftp:// host keys")
+	cookies := flag.String("cookies", "", "Load cookies from a Netscape format cookies.txt")
+	var tlsOpts TLSOptions
+	flag.StringVar(&tlsOpts.CACert, "ca-cert", "", "PEM file of extra CA certificates to trust")
+	flag.StringVar(&tlsOpts.ClientCert, "client-cert", "", "PEM client certificate for mTLS")
+	flag.StringVar(&tlsOpts.ClientKey, "client-key", "", "PEM client private key, defaults to -client-cert")
+	flag.BoolVar(&tlsOpts.Insecure, "insecure", false, "Skip TLS certificate verification (dangerous)")
+	flag.StringVar(&tlsOpts.MinVersion, "tls-min", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2, 1.3")
+	flag.StringVar(&tlsOpts.Pins, "pin", "", "Pinned public keys, sha256//base64[;sha256//base64...]")
+	flag.StringVar(&streamVariant, "variant", "", "HLS/DASH variant: best (default), worst, <height>p like 720p, or maximum bandwidth in bits/s")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "S3 compatible endpoint for s3:// URLs (path-style), defaults to AWS_ENDPOINT_URL or AWS")
+	flag.StringVar(&s3Profile, "s3-profile", "", "Profile in ~/.aws/credentials and ~/.aws/config, defaults to AWS_PROFILE or default")
+	flag.BoolVar(&recursive, "r", false, "Mirror an HTTP directory index (nginx/Apache autoindex), staying under the starting path")
+	flag.IntVar(&mirrorDepth, "depth", mirrorDepth, "Maximum directory depth for -r")
+	flag.Var(&includePatterns, "include", "Only download files matching this glob (name, or path if it contains /) or re:regex, repeatable")
+	flag.Var(&excludePatterns, "exclude", "Skip files matching this glob or re:regex, repeatable")
+	flag.IntVar(&parallelJobs, "jobs", parallelJobs, "Number of files downloaded at once when mirroring")
+	flag.BoolVar(&followTorrent, "follow-torrent", followTorrent, "Download the content of .torrent URLs instead of the .torrent file itself (magnet links and local .torrent files always are)")
+	flag.StringVar(&reportFile, "report", "", "Save a JSON report (timings, throughput, per-block stats, redirects, checksums) to this file, an array when several files are downloaded")
+	flag.StringVar(&logFile, "log-file", "", "Write logs to this file instead of stderr, rotated by size")
+	flag.StringVar(&logFormat, "log-format", logFormat, "Log format: text or json (one object per line with fields such as job, block, attempt, host, status)")
+	flag.IntVar(&logMaxSize, "log-max-size", logMaxSize, "Rotate -log-file when it would exceed this many bytes, 0 to disable")
+	flag.IntVar(&logBackups, "log-backups", logBackups, "Number of rotated log files to keep")
+	flag.StringVar(&profilesFile, "profiles-file", defaultProfilesFile(), "Database of learned per-host settings (threads, HEAD and range support, speed), empty to disable")
+	cfgFile := flag.String("config", "", "Config file, defaults to GODOWN_CONFIG or $XDG_CONFIG_HOME/godown/config.toml")
 	ll := flag.String("ll", "info", "Log level: trace, debug, info, warn/warning, error, fatal, panic")
 	pbt := flag.Bool("pbt", true, "Show total progress bar")
 	pbs := flag.Bool("pbs", true, "Show thread progress bar")
+	pm := flag.String("progress", PROGRESS_AUTO, "Progress output: bar, plain (no ANSI, periodic log lines), json (periodic JSON lines), auto picks plain when stdout is not a terminal")
+	pfd := flag.Int("progress-fd", 2, "File descriptor receiving -progress=json lines")
+	flag.DurationVar(&progressInterval, "progress-interval", 0, "Interval between plain/json progress lines, defaults to 5s for plain and 1s for json")
 	flag.Parse()
 
+	var host string
+	if u, err := url.Parse(flag.Arg(0)); err == nil {
+		host = u.Hostname()
+	}
+
+	// 配置文件与 GODOWN_* 只填充命令行未给出的参数
+	cfgPath := *cfgFile
+	if cfgPath == "" {
+		cfgPath = defaultConfigFile()
+	}
+	if cfgPath != "" {
+		cfg, err := LoadConfig(cfgPath, *cfgFile == "")
+		if err != nil {
+			log.Fatalf("Failed to load config %s: %v", cfgPath, err)
+		}
+		if err := cfg.Apply(flag.CommandLine, host, &headers); err != nil {
+			log.Fatalf("Failed to apply config %s: %v", cfgPath, err)
+		}
+		hostConfig = cfg
+	}
+
 	if *dir != "" {
 		DownloadsFolder = *dir
 	} else {
@@ -51,16 +165,99 @@ func Init() {
 		}
 	}
 
-	if *p != "" {
-		proxyURL, err := url.Parse(*p)
+	TempFolder = *tmp
+	writeXattrs = *xattr
+
+	if *sum != "" {
+		c, err := ParseChecksum(*sum)
+		if err != nil {
+			log.Fatalf("Failed to parse checksum: %v", err)
+		}
+		checksum = c
+	}
+
+	for _, p := range []struct {
+		s   string
+		dst **url.URL
+	}{
+		{*p, &Proxy.All},
+		{*hp, &Proxy.HTTP},
+		{*hsp, &Proxy.HTTPS},
+		{*mp, &Proxy.Mega},
+	} {
+		if p.s == "" {
+			continue
+		}
+		proxyURL, err := ParseProxyURL(p.s)
 		if err != nil {
 			log.Fatalf("Failed to parse proxy URL: %v", err)
 		}
-		ProxyURL = proxyURL
+		*p.dst = proxyURL
 	}
+	Proxy.NoProxy = ParseNoProxy(*np)
 
 	threadNum = *t
-	blockSize = *bs
+	var learned *HostProfile // 命令行与配置都未指定线程数时使用学到的
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if p := lookupProfile(host); p != nil && p.Threads > 0 && !set["t"] {
+		threadNum, learned = p.Threads, p
+	}
+	blockSize = int(bs)
+
+	dialTimeout = *dt
+	tlsTimeout = *tt
+	headerTimeout = *ht
+	idleTimeout = *it
+	stallTimeout = *st
+	maxRedirects = *mr
+	tc, err := tlsOpts.Config()
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	if tlsOpts.Insecure {
+		log.Warn("TLS certificate verification disabled")
+	}
+	tlsConfig = tc
+
+	switch *hv {
+	case "", "1.1", "2":
+	case "3":
+		if !http3Supported {
+			log.Fatal("HTTP/3 support is not compiled in, rebuild with -tags http3")
+		}
+		log.Warn("HTTP/3 is experimental and ignores proxy settings")
+	default:
+		log.Fatalf("Unknown HTTP version: %s", *hv)
+	}
+	httpVersion = *hv
+	Client = NewClient() // 按参数重建 Transport
+
+	NetrcFile = *netrcFile
+
+	if *cookies != "" {
+		jar, err := LoadCookies(*cookies)
+		if err != nil {
+			log.Fatalf("Failed to load cookies: %v", err)
+		}
+		Client.Jar = jar
+	}
+
+	jobHeader = DefaultHeader.Clone()
+	if *ua != "" {
+		jobHeader.Set("User-Agent", *ua)
+	}
+	if *referer != "" {
+		jobHeader.Set("Referer", *referer)
+	}
+	headers.Apply(jobHeader)
+
+	if *user != "" || *bearer != "" {
+		jobAuth = &Auth{Bearer: *bearer}
+		if *user != "" {
+			jobAuth.User, jobAuth.Password = ParseUserPass(*user)
+		}
+	}
 
 	l, err := log.ParseLevel(*ll)
 	if err != nil {
@@ -70,18 +267,69 @@ func Init() {
 
 	showTotalProgressBar = *pbt
 	showThreadProgressBar = *pbs
+	if err := setupProgress(*pm, *pfd); err != nil {
+		log.Fatalf("Failed to set up progress output: %v", err)
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	if learned != nil {
+		log.Infof("Using %d threads learned for %s (-t to override)", learned.Threads, host)
+	}
 }
 
 func main() {
 	Init()
+	defer closeLog()
 
 	args := flag.Args()
 	if len(args) < 1 || args[0] == "" {
 		flag.Usage()
-		os.Exit(1)
+		log.Exit(1) // 执行 closeLog
+	}
+	if args[0] == "profiles" {
+		if err := profilesCommand(args[1:]); err != nil {
+			log.Fatalf("Failed to manage host profiles: %v", err)
+		}
+		return
+	}
+	if err := checkDownloadsFolder(DownloadsFolder); err != nil {
+		log.Fatalf("Downloads folder is not usable: %v", err)
 	}
 
-	j := &Job{Url: args[0]}
-	j.Start()
+	j := &Job{Url: args[0], Header: jobHeader, Auth: jobAuth, Checksum: checksum}
+	if jobAuth != nil {
+		u, err := url.Parse(j.Url)
+		if err != nil {
+			log.Fatalf("Failed to parse URL: %v", err)
+		}
+		jobAuth.Host = u.Host
+	}
+
+	// 前缀与目录展开为多个任务, 按相对路径放入子目录
+	var urls, dirs []string
+	var err error
+	switch ctx := context.Background(); {
+	case isS3Prefix(j.Url):
+		urls, dirs, err = listS3(ctx, j.Url, jobHeader)
+	case isWebDAV(ctx, j.Url, jobHeader, jobAuth):
+		urls, dirs, err = listWebDAV(ctx, j.Url, jobHeader, jobAuth)
+	case recursive:
+		urls, dirs, err = crawlIndex(ctx, j.Url, jobHeader, jobAuth)
+	default:
+		j.Start()
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to list %s: %v", redactUrl(j.Url), err)
+	}
+	log.Infof("Found %d files under %s", len(urls), redactUrl(j.Url))
+	r := &Runner{Parallel: parallelJobs}
+	for i, u := range urls {
+		r.Add(&Job{Url: u, Header: jobHeader, Auth: jobAuth, SubDir: dirs[i]})
+	}
+	if r.Run() > 0 {
+		log.Exit(1) // 执行 closeLog
+	}
 
 }
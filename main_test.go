@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHeaderFlags(t *testing.T) {
+	var h headerFlags
+	for _, s := range []string{"user-agent: curl/8.0", "X-Token: a", "x-token: b", "Cache-Control:"} {
+		if err := h.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Set("bad header"); err == nil {
+		t.Fatal("header without colon should be rejected")
+	}
+
+	header := DefaultHeader.Clone()
+	h.Apply(header)
+	if ua := header.Values("User-Agent"); len(ua) != 1 || ua[0] != "curl/8.0" {
+		t.Errorf("User-Agent: %v", ua)
+	}
+	if v := header.Values("X-Token"); len(v) != 2 {
+		t.Errorf("X-Token: %v", v)
+	}
+	if header.Get("Cache-Control") != "" {
+		t.Error("Cache-Control should be removed")
+	}
+}
+
+func TestCheckDownloadsFolder(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a", "b")
+	if err := checkDownloadsFolder(dir); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("probe file left behind: %v", entries)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if checkDownloadsFolder(filepath.Join(file, "sub")) == nil {
+		t.Fatal("path below a file should fail")
+	}
+
+	if _, err := DiskFree(dir); err != nil {
+		t.Skip(err)
+	}
+	defer func(n zeroSizeFlag) { minFreeSpace = n }(minFreeSpace)
+	minFreeSpace = 1 << 62
+	if err := checkDownloadsFolder(dir); err == nil || !strings.Contains(err.Error(), "free") {
+		t.Fatalf("want free space error, got %v", err)
+	}
+}
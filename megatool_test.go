@@ -5,14 +5,18 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestBase64UrlDecode(t *testing.T) {
@@ -198,3 +202,50 @@ func TestOpenFolder(t *testing.T) {
 	}
 
 }
+
+func TestMegaJobModTime(t *testing.T) {
+	setupDownload(t, 1000, 3) // 块不按 16 字节对齐
+	data := randomData(4321)
+	nodeKey := randomData(32)
+	aesKey, _, nonce := unpackKey(nodeKey)
+	ts := time.Date(2024, 10, 20, 5, 42, 14, 0, time.UTC)
+
+	block, _ := aes.NewCipher(aesKey)
+	enc := make([]byte, len(data))
+	cipher.NewCTR(block, slices.Concat(nonce, make([]byte, 8))).XORKeyStream(enc, data)
+
+	fp := append(make([]byte, 16), 4)
+	fp = binary.LittleEndian.AppendUint32(fp, uint32(ts.Unix()))
+	attr := []byte(`MEGA{"n":"m.bin","c":"` + base64.RawURLEncoding.EncodeToString(fp) + `"}`)
+	attr = append(attr, make([]byte, 16-len(attr)%16)...)
+	cipher.NewCBCEncrypter(block, make([]byte, 16)).CryptBlocks(attr, attr)
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cs" {
+			fmt.Fprintf(w, `[{"g":"%s/dl/x","at":"%s","s":%d}]`, srv.URL, base64.RawURLEncoding.EncodeToString(attr), len(data))
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.URL.Path, "/dl/x/%d-%d", &start, &end); err != nil || end >= len(data) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(enc[start : end+1])
+	}))
+	defer srv.Close()
+	defer func(u string) { megaApiUrl = u }(megaApiUrl)
+	megaApiUrl = srv.URL
+
+	j := &Job{Url: "https://mega.nz/file/ABCDEFGH#" + base64.RawURLEncoding.EncodeToString(nodeKey)}
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "m.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("content mismatch: %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(DownloadsFolder, "m.bin")); !info.ModTime().Equal(ts) {
+		t.Fatalf("mtime: %v, want %v", info.ModTime(), ts)
+	}
+}
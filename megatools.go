@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/binary"
@@ -12,6 +13,7 @@ import (
 	"regexp"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,6 +28,8 @@ const (
 	maxSleepTime = 5 * time.Second       // for retries
 )
 
+var megaApiUrl = API_URL // 测试时替换
+
 func ExportMegaLink(link string) (decryptMw func(io.Reader) io.Reader, err error) {
 	s := NewMegaSession()
 
@@ -50,6 +54,49 @@ func ExportMegaLink(link string) (decryptMw func(io.Reader) io.Reader, err error
 	}
 }
 
+// initMega 解析文件链接, 取得下载地址, 大小, 文件名与节点时间戳
+func (j *Job) initMega() error {
+	l := parseLink(j.Url)
+	if l == nil || l.Type != LINK_FILE {
+		return fmt.Errorf("unsupported MEGA link: %s", redactUrl(j.Url))
+	}
+	params, err := NewMegaSession().prepareDownload(l.Handle, l.Key)
+	if err != nil {
+		return err
+	}
+	j.mega = &mega{id: l.Handle, key: l.Key, ts: params.nodeTs, params: params}
+	j.setFinalUrl(params.downloadUrl)
+	j.fileName = params.nodeName
+	j.size = int(params.nodeSize)
+	j.acceptRanges = true // 下载地址支持 /start-end
+	return nil
+}
+
+// openMegaBlock 请求块的密文并解密
+func (j *Job) openMegaBlock(ctx context.Context, block *Block) (io.ReadCloser, error) {
+	req, err := j.newRequest(ctx, "GET", fmt.Sprintf("%s/%d-%d", j.getFinalUrl(), block.start, block.end))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("block %d: http status: %s", block.index, resp.Status)
+	}
+	r, err := j.mega.params.decryptAt(resp.Body, int64(block.start))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, resp.Body}, nil
+}
+
 type MegaSession struct {
 	// http *http.Client
 	// maxUL int
@@ -91,6 +138,7 @@ type MegaDownloadDataParams struct {
 	downloadUrl string
 	nodeName    string
 	nodeSize    uint64
+	nodeTs      int64 // 修改时间, 来自属性中的指纹
 	aesKey      []byte
 	nonce       []byte
 	// metaMacXor  []byte // 计算文件 MAC 用, 不实现
@@ -113,6 +161,19 @@ func (p *MegaDownloadDataParams) Export() (decryptMw func(io.Reader) io.Reader,
 	}, nil
 }
 
+// decryptAt 解密从 offset 开始的数据, 计数器为 offset/16
+func (p *MegaDownloadDataParams) decryptAt(r io.Reader, offset int64) (io.Reader, error) {
+	block, err := aes.NewCipher(p.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := binary.BigEndian.AppendUint64(slices.Clone(p.nonce), uint64(offset/16))
+	stream := cipher.NewCTR(block, iv)
+	skip := make([]byte, offset%16) // 块内偏移
+	stream.XORKeyStream(skip, skip)
+	return cipher.StreamReader{S: stream, R: r}, nil
+}
+
 type MegaDownloadReq [1]struct {
 	Cmd string `json:"a"`
 	G   int    `json:"g"`
@@ -195,6 +256,7 @@ func (s *MegaSession) prepareDownload(handle, key string) (*MegaDownloadDataPara
 		downloadUrl: url,
 		nodeName:    attr.Name,
 		nodeSize:    size,
+		nodeTs:      fingerprintMtime(attr.Fingerprint),
 		aesKey:      aesKey,
 		nonce:       nonce,
 		// metaMacXor:  metaMacXor,
@@ -202,7 +264,25 @@ func (s *MegaSession) prepareDownload(handle, key string) (*MegaDownloadDataPara
 }
 
 type FileAttr struct {
-	Name string `json:"n"`
+	Name        string `json:"n"`
+	Fingerprint string `json:"c,omitempty"` // 16 字节 CRC + 序列化的修改时间
+}
+
+// fingerprintMtime 从文件指纹中取出修改时间, 无法解析时为 0
+func fingerprintMtime(fp string) int64 {
+	b, err := base64UrlDecode(fp)
+	if err != nil || len(b) < 17 {
+		return 0
+	}
+	n := int(b[16])
+	if n > 8 || len(b) < 17+n {
+		return 0
+	}
+	var ts int64
+	for i := n - 1; i >= 0; i-- { // 小端
+		ts = ts<<8 | int64(b[17+i])
+	}
+	return ts
 }
 
 var attrJsonMatch = regexp.MustCompile(`{".*"}`)
@@ -276,7 +356,7 @@ func (s *MegaSession) apiRequest(req []byte) (resp []byte, err error) {
 		}
 	}
 
-	url := API_URL
+	url := megaApiUrl
 	url += "/cs?id=" + strconv.FormatInt(s.sn, 10)
 	// if s.sid != "" {
 	// 	url += "&sid=" + s.sid
@@ -288,9 +368,11 @@ func (s *MegaSession) apiRequest(req []byte) (resp []byte, err error) {
 	var request *http.Request
 	var response *http.Response
 	sleepTime := minSleepTime
+	logger := log.WithField("host", strings.TrimPrefix(megaApiUrl, "https://"))
+	status := 0
 	for i := 0; i < RETRIES+1; i++ {
 		if i != 0 {
-			log.Debugf("Retry API request %d/%d: %v", i, RETRIES+1, err)
+			logger.WithFields(log.Fields{"attempt": i, "status": status}).Debugf("Retry API request %d/%d: %v", i, RETRIES+1, err)
 			backOffSleep(&sleepTime)
 		}
 
@@ -298,11 +380,13 @@ func (s *MegaSession) apiRequest(req []byte) (resp []byte, err error) {
 		if err != nil {
 			continue
 		}
+		request.Header = DefaultHeader.Clone()
 		request.Header.Set("Content-Type", "application/json")
 		response, err = Client.Do(request)
 		if err != nil {
 			continue
 		}
+		status = response.StatusCode
 		if response.StatusCode != 200 {
 			err = fmt.Errorf("http status: %s", response.Status)
 			_ = response.Body.Close()
@@ -317,7 +401,7 @@ func (s *MegaSession) apiRequest(req []byte) (resp []byte, err error) {
 		if err != nil {
 			continue
 		}
-		log.Debug("API response: ", string(resp))
+		logger.WithField("status", status).Debug("API response: ", string(resp))
 
 		if !bytes.HasPrefix(resp, []byte("[")) && !bytes.HasPrefix(resp, []byte("-")) {
 			return nil, ErrBadResp
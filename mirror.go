@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+var (
+	recursive          = false // 递归下载目录索引页
+	mirrorDepth        = 5     // 递归层数, 起始页为 0
+	maxIndexPage int64 = 8 << 20
+)
+
+// patternFlags 可重复的过滤规则, re: 开头为正则, 否则为 glob
+type patternFlags []string
+
+func (p *patternFlags) String() string { return strings.Join(*p, ", ") }
+func (p *patternFlags) Set(v string) error {
+	if re, ok := strings.CutPrefix(v, "re:"); ok {
+		if _, err := regexp.Compile(re); err != nil {
+			return err
+		}
+	} else if _, err := path.Match(v, ""); err != nil {
+		return fmt.Errorf("bad glob %q: %w", v, err)
+	}
+	*p = append(*p, v)
+	return nil
+}
+
+var includePatterns, excludePatterns patternFlags
+
+// matchPattern glob 含 / 时匹配相对路径, 否则匹配文件名; 正则匹配相对路径
+func matchPattern(pattern, rel string) bool {
+	if re, ok := strings.CutPrefix(pattern, "re:"); ok {
+		return regexp.MustCompile(re).MatchString(rel)
+	}
+	name := rel
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(rel)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// wanted 有 include 时至少匹配一条, 且不匹配任何 exclude
+func wanted(rel string, include, exclude []string) bool {
+	for _, p := range exclude {
+		if matchPattern(p, rel) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, p := range include {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLinks 提取 <a href>
+func parseLinks(r io.Reader) []string {
+	var links []string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" {
+				continue
+			}
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				if string(k) == "href" {
+					links = append(links, string(v))
+				}
+			}
+		}
+	}
+}
+
+// fetchIndex 下载索引页, 返回链接与重定向后的地址
+func (j *Job) fetchIndex(ctx context.Context, rawUrl string) ([]string, *url.URL, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	req, err := j.newRequest(ctx, "GET", rawUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("index %s: http status: %s", redactUrl(rawUrl), resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "text/html" && mt != "application/xhtml+xml" {
+		return nil, nil, fmt.Errorf("%s is not an HTML index page", redactUrl(rawUrl))
+	}
+	return parseLinks(io.LimitReader(resp.Body, maxIndexPage)), resp.Request.URL, nil
+}
+
+// crawlIndex 按层遍历 nginx/Apache 等目录索引页, 只跟随起始路径下的链接,
+// 以 / 结尾的链接视为子目录, 返回文件地址与相对起始路径的子目录
+func crawlIndex(ctx context.Context, start string, header http.Header, auth *Auth) (urls, dirs []string, err error) {
+	j := &Job{Header: header, Auth: auth}
+	links, base, err := j.fetchIndex(ctx, start)
+	if err != nil {
+		return nil, nil, err
+	}
+	root := *base
+	root.RawQuery, root.Fragment = "", ""
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path = path.Dir(root.Path) + "/"
+		root.RawPath = ""
+	}
+
+	type page struct {
+		url   *url.URL
+		links []string
+		depth int
+	}
+	queue := []page{{base, links, 0}}
+	seen := map[string]bool{root.String(): true}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, href := range p.links {
+			u, err := p.url.Parse(href)
+			if err != nil || u.RawQuery != "" || (u.Scheme != "http" && u.Scheme != "https") {
+				continue // 排序链接等
+			}
+			u.Fragment = ""
+			if u.Host != root.Host || !strings.HasPrefix(u.Path, root.Path) || seen[u.String()] {
+				continue // 上级目录与其他站点
+			}
+			seen[u.String()] = true
+			rel := strings.TrimPrefix(u.Path, root.Path)
+			if rel == "" || !filepath.IsLocal(filepath.FromSlash(strings.TrimSuffix(rel, "/"))) {
+				continue
+			}
+
+			if strings.HasSuffix(u.Path, "/") {
+				if p.depth+1 > mirrorDepth {
+					log.Debugf("Depth limit reached, skipping %s", redactUrl(u.String()))
+					continue
+				}
+				links, final, err := j.fetchIndex(ctx, u.String())
+				if err != nil {
+					log.Warnf("Skipping %v", err)
+					continue
+				}
+				if strings.HasPrefix(final.Path, root.Path) {
+					queue = append(queue, page{final, links, p.depth + 1})
+				}
+				continue
+			}
+			if !wanted(rel, includePatterns, excludePatterns) {
+				continue
+			}
+			dir := path.Dir(rel)
+			if dir == "." {
+				dir = ""
+			}
+			urls = append(urls, u.String())
+			dirs = append(dirs, filepath.FromSlash(dir))
+		}
+	}
+	return urls, dirs, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern, rel string
+		want         bool
+	}{
+		{"*.iso", "sub/a.iso", true},
+		{"*.iso", "a.img", false},
+		{"sub/*.iso", "sub/a.iso", true},
+		{"sub/*.iso", "other/a.iso", false},
+		{"re:^sub/.*\\.iso$", "sub/deep/a.iso", true},
+		{"re:\\.txt$", "a.iso", false},
+	} {
+		if got := matchPattern(c.pattern, c.rel); got != c.want {
+			t.Errorf("%s %s: %v", c.pattern, c.rel, got)
+		}
+	}
+	if !wanted("a.iso", nil, nil) || wanted("a.iso", []string{"*.img"}, nil) || wanted("a.iso", nil, []string{"a.*"}) {
+		t.Fatal("wanted")
+	}
+	var p patternFlags
+	if p.Set("re:(") == nil || p.Set("[") == nil {
+		t.Fatal("invalid patterns should be rejected")
+	}
+}
+
+// newIndexServer 模拟 nginx autoindex
+func newIndexServer(t *testing.T) (*httptest.Server, map[string][]byte) {
+	files := map[string][]byte{
+		"/pub/a.iso":            randomData(3000),
+		"/pub/notes.txt":        []byte("notes"),
+		"/pub/sub/b.iso":        randomData(4000),
+		"/pub/sub/deep/c.iso":   randomData(5000),
+		"/pub/sub/deep/d e.iso": randomData(100),
+		"/private/secret.iso":   []byte("secret"),
+	}
+	pages := map[string]string{
+		"/pub/": `<html><body><h1>Index of /pub/</h1><hr><pre>
+<a href="../">../</a>
+<a href="?C=N;O=D">Name</a>
+<a href="#top">top</a>
+<a href="a.iso">a.iso</a>
+<a href="notes.txt">notes.txt</a>
+<a href="sub/">sub/</a>
+<a href="/private/secret.iso">secret</a>
+<a href="http://other.example/x.iso">mirror</a>
+</pre></body></html>`,
+		"/pub/sub/":      `<a href="../">../</a><a href="b.iso">b.iso</a><a href="deep/">deep/</a><a href="/pub/sub/b.iso">dup</a>`,
+		"/pub/sub/deep/": `<a href="../">../</a><a href="c.iso">c.iso</a><a href="d%20e.iso">d e.iso</a>`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := pages[r.URL.Path]; ok {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(p))
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, files
+}
+
+func TestCrawlIndex(t *testing.T) {
+	srv, _ := newIndexServer(t)
+	defer func(d int, in, ex patternFlags) { mirrorDepth, includePatterns, excludePatterns = d, in, ex }(mirrorDepth, includePatterns, excludePatterns)
+
+	rels := func(urls []string) []string {
+		var res []string
+		for _, u := range urls {
+			res = append(res, strings.TrimPrefix(u, srv.URL+"/pub/"))
+		}
+		slices.Sort(res)
+		return res
+	}
+
+	mirrorDepth, includePatterns, excludePatterns = 1, patternFlags{"*.iso"}, nil
+	urls, dirs, err := crawlIndex(context.Background(), srv.URL+"/pub/", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rels(urls); !slices.Equal(got, []string{"a.iso", "sub/b.iso"}) {
+		t.Fatalf("depth 1: %v", got)
+	}
+	if i := slices.Index(urls, srv.URL+"/pub/sub/b.iso"); dirs[i] != "sub" {
+		t.Fatalf("dir: %q", dirs[i])
+	}
+
+	mirrorDepth, excludePatterns = 5, patternFlags{"re:^sub/b"}
+	urls, _, err = crawlIndex(context.Background(), srv.URL+"/pub/", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rels(urls); !slices.Equal(got, []string{"a.iso", "sub/deep/c.iso", "sub/deep/d%20e.iso"}) {
+		t.Fatalf("exclude: %v", got)
+	}
+
+	if _, _, err = crawlIndex(context.Background(), srv.URL+"/pub/a.iso", nil, nil); err == nil {
+		t.Fatal("non HTML start page should fail")
+	}
+}
+
+func TestRunnerMirror(t *testing.T) {
+	setupDownload(t, 0, 0)
+	srv, files := newIndexServer(t)
+	defer func(d int, in, ex patternFlags) { mirrorDepth, includePatterns, excludePatterns = d, in, ex }(mirrorDepth, includePatterns, excludePatterns)
+	mirrorDepth, includePatterns, excludePatterns = 5, nil, nil
+
+	urls, dirs, err := crawlIndex(context.Background(), srv.URL+"/pub/", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Runner{Parallel: 2}
+	for i, u := range urls {
+		r.Add(&Job{Url: u, SubDir: dirs[i]})
+	}
+	r.Add(&Job{Url: srv.URL + "/pub/missing.iso"})
+	if failed := r.Run(); failed != 1 {
+		t.Fatalf("failed: %d", failed)
+	}
+
+	for p, data := range files {
+		rel, ok := strings.CutPrefix(p, "/pub/")
+		got, err := os.ReadFile(filepath.Join(DownloadsFolder, filepath.FromSlash(rel)))
+		if !ok {
+			if err == nil {
+				t.Fatalf("%s should not be mirrored", p)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: %v", rel, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NetrcEntry .netrc 中的一项
+type NetrcEntry struct {
+	Login    string
+	Password string
+}
+
+// Netrc 按主机名索引的凭据
+type Netrc struct {
+	Machines map[string]NetrcEntry
+	Default  *NetrcEntry
+}
+
+// NetrcFile 凭据文件, 为空时不查询
+var NetrcFile = defaultNetrcFile()
+
+var (
+	netrcOnce  sync.Once
+	netrc      *Netrc
+	netrcAuths sync.Map // host -> *Auth, 已经响应过质询的主机
+)
+
+func defaultNetrcFile() string {
+	if f := os.Getenv("NETRC"); f != "" {
+		return f
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc")
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// ParseNetrc 解析 .netrc, 忽略 macdef
+func ParseNetrc(path string) (*Netrc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	n := &Netrc{Machines: map[string]NetrcEntry{}}
+	var (
+		cur     *NetrcEntry
+		machine string
+		inMacro bool
+	)
+	commit := func() {
+		if cur == nil {
+			return
+		}
+		if machine == "" {
+			n.Default = cur
+		} else if _, ok := n.Machines[machine]; !ok { // 同 curl, 取第一项
+			n.Machines[machine] = *cur
+		}
+		cur = nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro { // macdef 以空行结束
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			next := func() string {
+				if i+1 < len(fields) {
+					i++
+					return strings.Trim(fields[i], `"`)
+				}
+				return ""
+			}
+			switch fields[i] {
+			case "machine":
+				commit()
+				machine = strings.ToLower(next())
+				cur = &NetrcEntry{}
+			case "default":
+				commit()
+				machine = ""
+				cur = &NetrcEntry{}
+			case "login":
+				if cur == nil {
+					return nil, fmt.Errorf("%s: login outside of machine", path)
+				}
+				cur.Login = next()
+			case "password":
+				if cur == nil {
+					return nil, fmt.Errorf("%s: password outside of machine", path)
+				}
+				cur.Password = next()
+			case "account":
+				next()
+			case "macdef":
+				commit()
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	commit()
+	return n, scanner.Err()
+}
+
+// Lookup 按主机名查找, 不区分端口
+func (n *Netrc) Lookup(host string) (NetrcEntry, bool) {
+	if n == nil {
+		return NetrcEntry{}, false
+	}
+	if e, ok := n.Machines[strings.ToLower(host)]; ok {
+		return e, true
+	}
+	if n.Default != nil {
+		return *n.Default, true
+	}
+	return NetrcEntry{}, false
+}
+
+func loadNetrc() *Netrc {
+	netrcOnce.Do(func() {
+		if NetrcFile == "" {
+			return
+		}
+		n, err := ParseNetrc(NetrcFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf("Failed to read %s: %v", NetrcFile, err)
+			}
+			return
+		}
+		netrc = n
+	})
+	return netrc
+}
+
+// netrcAuth 主机对应的 .netrc 凭据, create 为 false 时只返回已缓存的
+func netrcAuth(u *url.URL, create bool) *Auth {
+	if a, ok := netrcAuths.Load(u.Host); ok {
+		return a.(*Auth)
+	}
+	if !create {
+		return nil
+	}
+	e, ok := loadNetrc().Lookup(u.Hostname())
+	if !ok || e.Login == "" {
+		return nil
+	}
+	a, _ := netrcAuths.LoadOrStore(u.Host, &Auth{Host: u.Host, User: e.Login, Password: e.Password})
+	return a.(*Auth)
+}
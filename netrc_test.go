@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func writeNetrc(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".netrc")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useNetrc 替换全局 .netrc 并清空缓存
+func useNetrc(t *testing.T, path string) {
+	old := NetrcFile
+	reset := func() {
+		netrcOnce = sync.Once{}
+		netrc = nil
+		netrcAuths = sync.Map{}
+	}
+	NetrcFile = path
+	reset()
+	t.Cleanup(func() {
+		NetrcFile = old
+		reset()
+	})
+}
+
+func TestParseNetrc(t *testing.T) {
+	n, err := ParseNetrc(writeNetrc(t, `
+# comment
+machine mirror.internal login ci password s3cret
+machine Other.Host
+	login bob
+	account ignored
+	password "pw"
+macdef init
+cd /pub
+bin
+
+machine mirror.internal login second password nope
+default login anonymous password guest@
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]NetrcEntry{
+		"mirror.internal": {"ci", "s3cret"},
+		"other.host":      {"bob", "pw"},
+		"unknown":         {"anonymous", "guest@"},
+	} {
+		if e, ok := n.Lookup(host); !ok || e != want {
+			t.Errorf("Lookup(%s) = %v, %v, want %v", host, e, ok, want)
+		}
+	}
+}
+
+func TestNetrcChallenge(t *testing.T) {
+	var mu sync.Mutex
+	unauthorized := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "ci" || p != "s3cret" {
+			mu.Lock()
+			unauthorized++
+			mu.Unlock()
+			w.Header().Set("WWW-Authenticate", `Basic realm="mirror"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	host, _, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	useNetrc(t, writeNetrc(t, "machine "+host+" login ci password s3cret\n"))
+
+	j := &Job{}
+	for i := 0; i < 3; i++ {
+		req, _ := j.newRequest(context.Background(), "GET", srv.URL)
+		resp, err := j.do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: %s", i, resp.Status)
+		}
+	}
+	if unauthorized != 1 { // 之后的请求直接带上凭据
+		t.Fatalf("%d challenges, want 1", unauthorized)
+	}
+}
+
+func TestRedirectDropsCredentials(t *testing.T) {
+	gotAuth := make(chan string, 1)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth <- r.Header.Get("Authorization") + "|" + r.Header.Get("Cookie")
+	}))
+	defer other.Close()
+	_, port, _ := net.SplitHostPort(other.Listener.Addr().String())
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+port+"/file", http.StatusFound)
+	}))
+	defer origin.Close()
+	useNetrc(t, "")
+
+	header := DefaultHeader.Clone()
+	header.Set("Cookie", "session=abc")
+	j := &Job{
+		Url:    origin.URL + "/file",
+		Header: header,
+		Auth:   &Auth{Host: origin.Listener.Addr().String(), User: "u", Password: "p"},
+	}
+	req, _ := j.newRequest(context.Background(), "HEAD", j.Url)
+	resp, err := j.do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-gotAuth; got != "|" {
+		t.Fatalf("credentials forwarded across hosts: %q", got)
+	}
+}
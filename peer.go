@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	peerTimeout    = 30 * time.Second // 握手与等待 piece 数据
+	peerBlockLen   = 16 << 10         // 单个 request 的长度
+	peerPipeline   = 8                // 同时未完成的 request 数
+	peerMaxMessage = 1<<20 + 16
+	utMetadataID   = 1 // 本端 ut_metadata 扩展消息号
+)
+
+// peer wire 消息号
+const (
+	msgChoke      = 0
+	msgUnchoke    = 1
+	msgInterested = 2
+	msgHave       = 4
+	msgBitfield   = 5
+	msgRequest    = 6
+	msgPiece      = 7
+	msgExtended   = 20
+)
+
+// peerConn 一个 peer 的 TCP 连接, 同一时间只由一个块使用
+type peerConn struct {
+	addr       string
+	conn       net.Conn
+	r          *bufio.Reader
+	bitfield   []byte
+	choked     bool
+	interested bool
+
+	extMetadata  int // 对方的 ut_metadata 消息号, 0 为不支持
+	metadataSize int
+}
+
+// dialPeer 握手, wantExt 时发送扩展握手以获取 metadata (BEP 10),
+// 否则等待对方的 bitfield 或 have
+func dialPeer(ctx context.Context, addr string, hash, peerID [20]byte, wantExt bool) (*peerConn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &peerConn{addr: addr, conn: conn, r: bufio.NewReader(conn), choked: true}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+
+	hs := make([]byte, 0, 68)
+	hs = append(hs, 19)
+	hs = append(hs, "BitTorrent protocol"...)
+	reserved := make([]byte, 8)
+	reserved[5] |= 0x10 // 扩展协议
+	hs = append(hs, reserved...)
+	hs = append(hs, hash[:]...)
+	hs = append(hs, peerID[:]...)
+	if _, err = conn.Write(hs); err != nil {
+		return nil, c.fail(ctx, err)
+	}
+	resp := make([]byte, 68)
+	if _, err = io.ReadFull(c.r, resp); err != nil {
+		return nil, c.fail(ctx, err)
+	}
+	if resp[0] != 19 || string(resp[1:20]) != "BitTorrent protocol" {
+		return nil, c.fail(ctx, errors.New("bad handshake"))
+	}
+	if !bytes.Equal(resp[28:48], hash[:]) {
+		return nil, c.fail(ctx, errors.New("info hash mismatch"))
+	}
+
+	if wantExt {
+		if resp[25]&0x10 == 0 {
+			return nil, c.fail(ctx, errors.New("peer does not support extensions"))
+		}
+		m := map[string]any{"m": map[string]any{"ut_metadata": utMetadataID}}
+		if err = c.writeMsg(msgExtended, append([]byte{0}, bencode(m)...)); err != nil {
+			return nil, c.fail(ctx, err)
+		}
+	}
+	for {
+		id, _, err := c.readMsg()
+		if err != nil {
+			return nil, c.fail(ctx, err)
+		}
+		switch {
+		case wantExt && c.extMetadata > 0:
+		case !wantExt && (id == msgBitfield || id == msgHave):
+		default:
+			continue
+		}
+		break
+	}
+	if wantExt && c.metadataSize <= 0 {
+		return nil, c.fail(ctx, errors.New("peer has no metadata"))
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// fail 握手失败时关闭连接
+func (c *peerConn) fail(ctx context.Context, err error) error {
+	c.conn.Close()
+	return c.wrap(ctx, err)
+}
+
+func (c *peerConn) writeMsg(id byte, payload []byte) error {
+	b := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)+1))
+	b[4] = id
+	_, err := c.conn.Write(append(b, payload...))
+	return err
+}
+
+// readMsg 读取一条消息并更新 choke 与 bitfield 状态, keep-alive 返回 id -1
+func (c *peerConn) readMsg() (int, []byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(c.r, l[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n == 0 {
+		return -1, nil, nil
+	}
+	if n > peerMaxMessage {
+		return 0, nil, fmt.Errorf("message too long: %d", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(c.r, msg); err != nil {
+		return 0, nil, err
+	}
+	id, payload := int(msg[0]), msg[1:]
+
+	switch id {
+	case msgChoke:
+		c.choked = true
+	case msgUnchoke:
+		c.choked = false
+	case msgHave:
+		if len(payload) == 4 {
+			i := int(binary.BigEndian.Uint32(payload))
+			for len(c.bitfield) <= i/8 {
+				c.bitfield = append(c.bitfield, 0)
+			}
+			c.bitfield[i/8] |= 0x80 >> (i % 8)
+		}
+	case msgBitfield:
+		c.bitfield = bytes.Clone(payload)
+	case msgExtended:
+		if len(payload) > 0 && payload[0] == 0 {
+			v, err := bdecode(payload[1:])
+			if err != nil {
+				return 0, nil, err
+			}
+			m, _ := v.(map[string]any)
+			d := bdict(m)
+			c.extMetadata = d.dict("m").int("ut_metadata")
+			c.metadataSize = d.int("metadata_size")
+		}
+	}
+	return id, payload, nil
+}
+
+func (c *peerConn) has(i int) bool {
+	return i/8 < len(c.bitfield) && c.bitfield[i/8]&(0x80>>(i%8)) != 0
+}
+
+// downloadPiece 分成 16KiB 请求流水线下载, 被 choke 后重新请求未收到的部分
+func (c *peerConn) downloadPiece(ctx context.Context, index, size int) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	if !c.interested {
+		if err := c.writeMsg(msgInterested, nil); err != nil {
+			return nil, c.wrap(ctx, err)
+		}
+		c.interested = true
+	}
+
+	n := (size + peerBlockLen - 1) / peerBlockLen
+	buf := make([]byte, size)
+	got := make([]bool, n)
+	next, pending, done := 0, 0, 0
+	for done < n {
+		c.conn.SetDeadline(time.Now().Add(peerTimeout))
+		for ; !c.choked && pending < peerPipeline && next < n; next++ {
+			if got[next] {
+				continue
+			}
+			req := make([]byte, 12)
+			binary.BigEndian.PutUint32(req, uint32(index))
+			binary.BigEndian.PutUint32(req[4:], uint32(next*peerBlockLen))
+			binary.BigEndian.PutUint32(req[8:], uint32(min(peerBlockLen, size-next*peerBlockLen)))
+			if err := c.writeMsg(msgRequest, req); err != nil {
+				return nil, c.wrap(ctx, err)
+			}
+			pending++
+		}
+
+		id, payload, err := c.readMsg()
+		if err != nil {
+			return nil, c.wrap(ctx, err)
+		}
+		switch id {
+		case msgChoke: // 未完成的请求被丢弃
+			next, pending = 0, 0
+		case msgPiece:
+			if len(payload) < 8 || int(binary.BigEndian.Uint32(payload)) != index {
+				continue
+			}
+			begin := int(binary.BigEndian.Uint32(payload[4:]))
+			k := begin / peerBlockLen
+			if begin%peerBlockLen != 0 || k >= n || got[k] ||
+				len(payload)-8 != min(peerBlockLen, size-begin) {
+				continue
+			}
+			copy(buf[begin:], payload[8:])
+			got[k] = true
+			done++
+			pending = max(pending-1, 0)
+		}
+	}
+	c.conn.SetDeadline(time.Time{})
+	return buf, nil
+}
+
+// fetchMetadata BEP 9, 按 16KiB 分片请求 info 字典
+func (c *peerConn) fetchMetadata(ctx context.Context) ([]byte, error) {
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	defer stop()
+
+	if c.metadataSize > 16<<20 {
+		return nil, fmt.Errorf("metadata too large: %d", c.metadataSize)
+	}
+	buf := make([]byte, 0, c.metadataSize)
+	for piece := 0; len(buf) < c.metadataSize; piece++ {
+		c.conn.SetDeadline(time.Now().Add(peerTimeout))
+		req := bencode(map[string]any{"msg_type": 0, "piece": piece})
+		if err := c.writeMsg(msgExtended, append([]byte{byte(c.extMetadata)}, req...)); err != nil {
+			return nil, c.wrap(ctx, err)
+		}
+		for {
+			id, payload, err := c.readMsg()
+			if err != nil {
+				return nil, c.wrap(ctx, err)
+			}
+			if id != msgExtended || len(payload) == 0 || payload[0] != utMetadataID {
+				continue
+			}
+			v, n, err := bdecodePrefix(payload[1:])
+			if err != nil {
+				return nil, err
+			}
+			m, _ := v.(map[string]any)
+			d := bdict(m)
+			if d.int("piece") != piece {
+				continue
+			}
+			switch d.int("msg_type") {
+			case 1:
+			case 2:
+				return nil, errors.New("metadata request rejected")
+			default:
+				continue
+			}
+			data := payload[1+n:]
+			if len(buf)+len(data) > c.metadataSize {
+				return nil, errors.New("metadata longer than announced")
+			}
+			buf = append(buf, data...)
+			break
+		}
+	}
+	c.conn.SetDeadline(time.Time{})
+	return buf, nil
+}
+
+// wrap ctx 取消导致的连接关闭返回 ctx 的错误
+func (c *peerConn) wrap(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+func (c *peerConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	profilesFile = "" // 主机档案数据库, 为空时不记录, 由 Init 设置
+	profilesMu   sync.Mutex
+	headRecheck  = 7 * 24 * time.Hour // HEAD 不可用的记录过期后重新尝试
+)
+
+// HostProfile 从以往下载中学到的主机特性
+type HostProfile struct {
+	Threads      int             `json:"threads,omitempty"`     // 建议的线程数
+	MaxThreads   int             `json:"max_threads,omitempty"` // 出现重试后的上限, 0 为不限
+	Speeds       map[int]float64 `json:"speeds,omitempty"`      // 线程数 -> 平均速度
+	AcceptRanges *bool           `json:"accept_ranges,omitempty"`
+	HeadWorks    *bool           `json:"head_works,omitempty"`
+	HeadChecked  time.Time       `json:"head_checked,omitempty"` // 最近一次记录 HeadWorks 的时间
+	Speed        float64         `json:"speed"`                  // 最近几次的平均速度, 字节/秒
+	Downloads    int             `json:"downloads"`
+	Updated      time.Time       `json:"updated"`
+}
+
+// defaultProfilesFile $XDG_STATE_HOME/godown/hosts.json, 默认 ~/.local/state
+func defaultProfilesFile() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "godown", "hosts.json")
+}
+
+// loadProfiles 读取数据库, 文件不存在时为空
+func loadProfiles(file string) (map[string]*HostProfile, error) {
+	profiles := map[string]*HostProfile{}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return profiles, nil
+}
+
+// saveProfiles 写入临时文件后改名, 避免中断时损坏
+func saveProfiles(file string, profiles map[string]*HostProfile) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// skipHead 以往 HEAD 不可用且记录未过期
+func (p *HostProfile) skipHead() bool {
+	return p != nil && p.HeadWorks != nil && !*p.HeadWorks && time.Since(p.HeadChecked) < headRecheck
+}
+
+// lookupProfile 主机的档案, 没有记录时返回 nil
+func lookupProfile(host string) *HostProfile {
+	if profilesFile == "" || host == "" {
+		return nil
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles, err := loadProfiles(profilesFile)
+	if err != nil {
+		log.Warnf("Failed to load host profiles: %v", err)
+		return nil
+	}
+	return profiles[strings.ToLower(host)]
+}
+
+// learn 根据一次下载的结果更新档案
+func (p *HostProfile) learn(threads int, acceptRanges bool, head *bool, r *Report) {
+	p.Downloads++
+	p.Updated = time.Now()
+	if head != nil {
+		p.HeadWorks, p.HeadChecked = head, p.Updated
+	}
+	if r.Status != "done" {
+		return
+	}
+	p.AcceptRanges = &acceptRanges
+	if p.Speed == 0 {
+		p.Speed = r.AvgSpeed
+	} else {
+		p.Speed = 0.3*r.AvgSpeed + 0.7*p.Speed
+	}
+	if !acceptRanges || len(r.Blocks) < 2 { // 单线程或只有一块, 无法比较线程数
+		return
+	}
+
+	raised := false
+	if r.Retries > 0 && threads > 1 { // 可能被限制连接数, 下次减半
+		limit := max(threads/2, 1)
+		if p.MaxThreads == 0 || limit < p.MaxThreads {
+			p.MaxThreads = limit
+		}
+	} else {
+		if p.Speeds == nil {
+			p.Speeds = map[int]float64{}
+		}
+		if old, ok := p.Speeds[threads]; ok {
+			p.Speeds[threads] = 0.3*r.AvgSpeed + 0.7*old
+		} else {
+			p.Speeds[threads] = r.AvgSpeed
+		}
+		if p.MaxThreads > 0 && threads >= p.MaxThreads { // 上限处没有重试, 逐步放开, 超过测过的线程数时取消
+			p.MaxThreads, raised = threads*2, true
+			if p.MaxThreads > slices.Max(slices.Collect(maps.Keys(p.Speeds))) {
+				p.MaxThreads, raised = 0, false
+			}
+		}
+	}
+
+	p.Threads = 0
+	best := 0.0
+	for n, speed := range p.Speeds {
+		if (p.MaxThreads == 0 || n <= p.MaxThreads) && speed > best {
+			p.Threads, best = n, speed
+		}
+	}
+	if p.Threads == 0 || raised { // 下次试试新的上限
+		p.Threads = p.MaxThreads
+	}
+}
+
+// learnProfile 下载结束后记录主机档案
+func (j *Job) learnProfile() {
+	if profilesFile == "" || j.report == nil {
+		return
+	}
+	u, err := url.Parse(j.Url)
+	if err != nil || u.Hostname() == "" {
+		return
+	}
+	host := strings.ToLower(u.Hostname())
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles, err := loadProfiles(profilesFile)
+	if err != nil {
+		log.Warnf("Failed to load host profiles: %v", err)
+		return
+	}
+	p := profiles[host]
+	if p == nil {
+		p = &HostProfile{}
+		profiles[host] = p
+	}
+	p.learn(threadNum, j.acceptRanges, j.headWorks, j.report)
+	if err := saveProfiles(profilesFile, profiles); err != nil {
+		log.Warnf("Failed to save host profiles: %v", err)
+	}
+}
+
+// profilesCommand godown profiles [list | reset [host...]]
+func profilesCommand(args []string) error {
+	if profilesFile == "" {
+		return fmt.Errorf("host profiles are disabled")
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles, err := loadProfiles(profilesFile)
+	if err != nil {
+		return err
+	}
+
+	cmd := "list"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "list":
+		hosts := make([]string, 0, len(profiles))
+		for host := range profiles {
+			hosts = append(hosts, host)
+		}
+		slices.Sort(hosts)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tTHREADS\tMAX\tRANGES\tHEAD\tSPEED\tDOWNLOADS\tUPDATED")
+		for _, host := range hosts {
+			p := profiles[host]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s/s\t%d\t%s\n", host,
+				orDash(p.Threads), orDash(p.MaxThreads), yesNo(p.AcceptRanges), yesNo(p.HeadWorks),
+				FormatBytes(int(p.Speed)), p.Downloads, p.Updated.Format(time.DateTime))
+		}
+		return w.Flush()
+	case "reset":
+		if len(args) == 0 {
+			profiles = map[string]*HostProfile{}
+		}
+		for _, host := range args {
+			if _, ok := profiles[strings.ToLower(host)]; !ok {
+				return fmt.Errorf("no profile for %s", host)
+			}
+			delete(profiles, strings.ToLower(host))
+		}
+		if err := saveProfiles(profilesFile, profiles); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			log.Info("Reset all host profiles")
+		} else {
+			log.Infof("Reset host profiles: %s", strings.Join(args, ", "))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown profiles command %q, want list or reset [host...]", cmd)
+	}
+}
+
+func orDash(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func yesNo(b *bool) string {
+	switch {
+	case b == nil:
+		return "?"
+	case *b:
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostProfileLearn(t *testing.T) {
+	blocks := make([]BlockReport, 4)
+	p := &HostProfile{}
+	p.learn(8, true, nil, &Report{Status: "done", AvgSpeed: 800, Blocks: blocks})
+	p.learn(16, true, nil, &Report{Status: "done", AvgSpeed: 1600, Blocks: blocks})
+	if p.Threads != 16 || p.Downloads != 2 || *p.AcceptRanges != true || p.HeadWorks != nil {
+		t.Fatalf("profile: %+v", p)
+	}
+
+	// 16 线程出现重试, 上限减半后回到 8
+	p.learn(16, true, nil, &Report{Status: "done", AvgSpeed: 100, Retries: 5, Blocks: blocks})
+	if p.MaxThreads != 8 || p.Threads != 8 {
+		t.Fatalf("throttled: %+v", p)
+	}
+	p.learn(4, true, nil, &Report{Status: "done", AvgSpeed: 10, Retries: 1, Blocks: blocks})
+	if p.MaxThreads != 2 || p.Threads != 2 {
+		t.Fatalf("banned: %+v", p)
+	}
+
+	head := false
+	p.learn(2, false, &head, &Report{Status: "failed"})
+	if *p.HeadWorks || p.Downloads != 5 || p.Threads != 2 || !p.skipHead() {
+		t.Fatalf("failed download: %+v", p)
+	}
+
+	// 上限处没有重试, 上限逐步放开
+	p.learn(2, true, nil, &Report{Status: "done", AvgSpeed: 200, Blocks: blocks})
+	if p.MaxThreads != 4 || p.Threads != 4 {
+		t.Fatalf("recovered: %+v", p)
+	}
+	p.learn(4, true, nil, &Report{Status: "done", AvgSpeed: 400, Blocks: blocks})
+	if p.MaxThreads != 8 || p.Threads != 8 {
+		t.Fatalf("recovered: %+v", p)
+	}
+	p.learn(8, true, nil, &Report{Status: "done", AvgSpeed: 800, Blocks: blocks})
+	p.learn(16, true, nil, &Report{Status: "done", AvgSpeed: 1600, Blocks: blocks})
+	if p.MaxThreads != 0 || p.Threads != 16 {
+		t.Fatalf("limit lifted: %+v", p)
+	}
+
+	// HEAD 不可用的记录过期后重新尝试
+	p.HeadChecked = time.Now().Add(-headRecheck)
+	if p.skipHead() {
+		t.Fatalf("expired HEAD record: %+v", p)
+	}
+}
+
+func TestProfileSkipsHead(t *testing.T) {
+	setupDownload(t, 16*1024, 0)
+	defer func(f string) { profilesFile = f }(profilesFile)
+	profilesFile = filepath.Join(t.TempDir(), "hosts.json")
+
+	data := randomData(blockSize*3 + 1)
+	var heads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+			if r.URL.Path == "/h.bin" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			} else { // 预签名 URL 常见的 403 只说明这个文件
+				w.WriteHeader(http.StatusForbidden)
+			}
+			return
+		}
+		http.ServeContent(w, r, "h.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	if err := (&Job{Url: srv.URL + "/h.bin"}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	p := lookupProfile("127.0.0.1")
+	if p == nil || p.HeadWorks == nil || *p.HeadWorks || !*p.AcceptRanges || p.Threads != threadNum || p.Speed <= 0 {
+		t.Fatalf("profile: %+v", p)
+	}
+
+	j := &Job{Url: srv.URL + "/h.bin"}
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if heads.Load() != 1 || j.report.Status != "done" {
+		t.Fatalf("HEAD requests: %d, status: %s", heads.Load(), j.report.Status)
+	}
+	if p := lookupProfile("127.0.0.1"); p.Downloads != 2 {
+		t.Fatalf("downloads: %d", p.Downloads)
+	}
+
+	if err := profilesCommand([]string{"reset", "example.com"}); err == nil {
+		t.Fatal("resetting an unknown host should fail")
+	}
+	if err := profilesCommand([]string{"reset", "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if lookupProfile("127.0.0.1") != nil {
+		t.Fatal("profile should be removed")
+	}
+
+	if err := (&Job{Url: srv.URL + "/signed.bin"}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if p := lookupProfile("127.0.0.1"); p == nil || p.HeadWorks != nil {
+		t.Fatalf("403 should not be recorded: %+v", p)
+	}
+	if profilesCommand([]string{"frobnicate"}) == nil {
+		t.Fatal("unknown command should fail")
+	}
+}
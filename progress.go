@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// 进度输出方式
+const (
+	PROGRESS_AUTO  = "auto"  // 终端显示进度条, 否则 plain
+	PROGRESS_BAR   = "bar"   // mpb 进度条
+	PROGRESS_PLAIN = "plain" // 无 ANSI 的日志与定时进度行
+	PROGRESS_JSON  = "json"  // 定时输出 JSON 行
+)
+
+// 任务阶段
+const (
+	PHASE_PROBING = iota
+	PHASE_DOWNLOADING
+	PHASE_WRITING
+	PHASE_VERIFYING
+	PHASE_DONE
+	PHASE_FAILED
+	PHASE_PAUSED // 磁盘已满, 保留 .part 等待续传
+)
+
+var phaseNames = []string{"probing", "downloading", "writing", "verifying", "done", "failed", "paused"}
+
+// 块状态, JSON 中每块一个字符
+const (
+	BLOCK_PENDING = iota
+	BLOCK_ACTIVE
+	BLOCK_DOWNLOADED
+	BLOCK_WRITTEN
+	BLOCK_FAILED
+)
+
+var blockStateChars = "padwf"
+
+var (
+	progressMode     = PROGRESS_BAR             // 由 setupProgress 解析 auto
+	progressInterval time.Duration              // 进度行间隔, 0 时 json 1s, plain 5s
+	progressOut      io.Writer      = os.Stderr // json 输出位置
+	progressMu       sync.Mutex                 // 多任务共用 progressOut
+	plainOutput      bool                       // 不输出 ANSI 转义与超链接
+	jobSeq           atomic.Int64               // 任务编号
+)
+
+// setupProgress 解析 -progress, auto 时 stdout 不是终端则用 plain,
+// plain/json 关闭进度条, json 写入文件描述符 fd
+func setupProgress(mode string, fd int) error {
+	if mode == PROGRESS_AUTO {
+		mode = PROGRESS_BAR
+		if !term.IsTerminal(int(os.Stdout.Fd())) {
+			mode = PROGRESS_PLAIN
+		}
+	}
+	switch mode {
+	case PROGRESS_BAR:
+	case PROGRESS_PLAIN, PROGRESS_JSON:
+		showTotalProgressBar, showThreadProgressBar = false, false
+		plainOutput = true
+	default:
+		return fmt.Errorf("unknown progress mode: %s", mode)
+	}
+	if mode == PROGRESS_JSON {
+		switch fd {
+		case 1:
+			progressOut = os.Stdout
+		case 2:
+			progressOut = os.Stderr
+		default:
+			f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+			if _, err := f.Stat(); err != nil {
+				return fmt.Errorf("progress fd %d: %w", fd, err)
+			}
+			progressOut = f
+		}
+	}
+	progressMode = mode
+	return nil
+}
+
+// countReader 统计读取的字节数
+type countReader struct {
+	r io.Reader
+	n []*atomic.Int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for _, v := range c.n {
+		v.Add(int64(n))
+	}
+	return n, err
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (j *Job) setPhase(phase int32) {
+	if j.phase.Swap(phase) != phase && j.phaseChanged != nil {
+		select {
+		case j.phaseChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// progressLine -progress=json 的一行
+type progressLine struct {
+	Job     int64     `json:"job"`
+	Time    time.Time `json:"time"`
+	Url     string    `json:"url"`
+	File    string    `json:"file,omitempty"`
+	Phase   string    `json:"phase"`
+	Done    int64     `json:"done"`    // 已下载字节
+	Written int64     `json:"written"` // 已写入 .part 的字节
+	Total   int64     `json:"total"`   // -1 为未知
+	Speed   float64   `json:"speed"`   // 字节/秒, 平滑后
+	ETA     float64   `json:"eta"`     // 秒, -1 为未知
+	Blocks  string    `json:"blocks,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// startReporter plain/json 模式下定时输出进度, 返回的函数输出最终状态并停止
+func (j *Job) startReporter() func(err error) {
+	if j.id == 0 { // 日志字段也使用
+		j.id = jobSeq.Add(1)
+	}
+	if progressMode != PROGRESS_PLAIN && progressMode != PROGRESS_JSON {
+		return func(error) {}
+	}
+	interval := progressInterval
+	if interval <= 0 {
+		interval = time.Second
+		if progressMode == PROGRESS_PLAIN {
+			interval = 5 * time.Second
+		}
+	}
+
+	j.phaseChanged = make(chan struct{}, 1)
+	stop, stopped := make(chan error), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last, lastTime := j.received.Load(), time.Now()
+		var speed float64
+		for {
+			select {
+			case err := <-stop:
+				phase := j.phase.Load()
+				if phase != PHASE_PAUSED && (err != nil || phase != PHASE_DONE) {
+					j.phase.Store(PHASE_FAILED)
+				}
+				j.emitProgress(phase, speed, err)
+				return
+			case <-j.phaseChanged:
+				if progressMode == PROGRESS_JSON {
+					j.emitProgress(j.phase.Load(), speed, nil)
+				}
+			case now := <-ticker.C:
+				done := j.received.Load()
+				if dt := now.Sub(lastTime).Seconds(); dt > 0 {
+					inst := float64(max(done-last, 0)) / dt
+					speed = 0.3*inst + 0.7*speed // EWMA
+				}
+				last, lastTime = done, now
+				j.emitProgress(j.phase.Load(), speed, nil)
+			}
+		}
+	}()
+	return func(err error) {
+		stop <- err
+		<-stopped
+	}
+}
+
+// emitProgress 输出一次进度, reached 为失败前到达的阶段
+func (j *Job) emitProgress(reached int32, speed float64, err error) {
+	phase := j.phase.Load()
+	if phase == PHASE_PROBING && progressMode == PROGRESS_PLAIN {
+		return
+	}
+	line := progressLine{
+		Job:     j.id,
+		Time:    time.Now(),
+		Url:     redactUrl(j.Url),
+		Phase:   phaseNames[phase],
+		Done:    j.resumed.Load() + j.received.Load(),
+		Written: j.resumed.Load() + j.written.Load(),
+		Total:   -1,
+		Speed:   speed,
+		ETA:     -1,
+	}
+	if reached != PHASE_PROBING { // 探测结束后 fileName 与 size 才确定
+		line.File, line.Total = j.fileName, int64(j.size)
+	}
+	if line.Total > 0 && speed > 0 {
+		line.ETA = float64(max(line.Total-line.Done, 0)) / speed
+	}
+	if blocks := j.reportBlocks.Load(); blocks != nil {
+		var sb strings.Builder
+		for _, block := range *blocks {
+			sb.WriteByte(blockStateChars[block.state.Load()])
+		}
+		line.Blocks = sb.String()
+	}
+	if err != nil {
+		line.Error = err.Error()
+	}
+
+	if progressMode == PROGRESS_PLAIN {
+		j.logProgress(line)
+		return
+	}
+	b, _ := json.Marshal(line)
+	progressMu.Lock()
+	progressOut.Write(append(b, '\n'))
+	progressMu.Unlock()
+}
+
+// logProgress plain 模式的进度行
+func (j *Job) logProgress(line progressLine) {
+	var sb strings.Builder
+	if j.parent != nil { // Runner 中区分文件
+		fmt.Fprintf(&sb, "[%d] %s: ", line.Job, line.File)
+	}
+	sb.WriteString(line.Phase)
+	if line.Total > 0 {
+		fmt.Fprintf(&sb, " %.1f%% (%s / %s)", float64(line.Done)*100/float64(line.Total), FormatBytes(int(line.Done)), FormatBytes(int(line.Total)))
+	} else {
+		fmt.Fprintf(&sb, " %s", FormatBytes(int(line.Done)))
+	}
+	if line.Phase == phaseNames[PHASE_DOWNLOADING] {
+		fmt.Fprintf(&sb, ", %s/s", FormatBytes(int(line.Speed)))
+		if line.ETA >= 0 {
+			fmt.Fprintf(&sb, ", ETA %v", time.Duration(line.ETA*float64(time.Second)).Round(time.Second))
+		}
+	}
+	log.Info(sb.String())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/vbauerster/mpb/v8"
@@ -8,6 +9,9 @@ import (
 )
 
 func (j *Job) newProgressWithCtx() *mpb.Progress {
+	if j.shared != nil {
+		return j.shared
+	}
 	return mpb.NewWithContext(
 		j.ctx,
 		RefreshRate,
@@ -28,29 +32,100 @@ func (j *Job) newWritingBar() *mpb.Bar {
 	return bar
 }
 
-// newTotalBar 总下载进度条
+// newTotalBar 总下载进度条, 大小已知时按字节计, 由 trackTotalBar 更新
 func (j *Job) newTotalBar() *mpb.Bar {
-	bar := j.progress.New(int64(len(j.Blocks)),
+	if j.size <= 0 { // HLS/DASH 按块计
+		bar := j.progress.New(int64(len(j.Blocks)),
+			BarStyleMain,
+			mpb.PrependDecorators(
+				Spinner,
+				ETA,
+			),
+		)
+		bar.SetPriority(1)
+		return bar
+	}
+	bar := j.progress.New(int64(j.size),
 		BarStyleMain,
 		mpb.PrependDecorators(
 			Spinner,
-			ETA,
+			decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 30, decor.WC{C: decor.DextraSpace}), "DONE"),
+		),
+		mpb.AppendDecorators(
+			decor.CountersKibiByte("% .2f / % .2f"),
+			decor.OnComplete(decor.EwmaSpeed(decor.SizeB1024(0), " % .2f", 30), ""),
 		),
 	)
 	bar.SetPriority(1)
 	return bar
 }
 
-// newThreadBar 线程进度条
+// trackTotalBar 定时把在途块已下载的字节同步到总进度条
+func (j *Job) trackTotalBar(bar *mpb.Bar) (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		prev, last := j.resumed.Load(), time.Now() // 续传的部分不计入速度
+		bar.SetCurrent(prev)
+		for {
+			select {
+			case <-done:
+				bar.SetCurrent(j.resumed.Load() + j.received.Load())
+				return
+			case now := <-ticker.C:
+				cur := j.resumed.Load() + j.received.Load()
+				if cur >= prev {
+					bar.EwmaSetCurrent(cur, now.Sub(last))
+				} else { // 失败的块已扣除
+					bar.SetCurrent(cur)
+				}
+				prev, last = cur, now
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// newSummaryBar 活动连接数, 重试次数与平均速度
+func (j *Job) newSummaryBar(start time.Time) *mpb.Bar {
+	bar := j.progress.New(0,
+		mpb.NopStyle(),
+		mpb.PrependDecorators(
+			decor.Any(func(decor.Statistics) string {
+				avg := float64(j.received.Load()) / max(time.Since(start).Seconds(), 0.001)
+				return fmt.Sprintf("Conns: %d active, %d opened | Retries: %d | Avg: %s/s",
+					j.active.Load(), j.conns.Load(), j.retries.Load(), FormatBytes(int(avg)))
+			}),
+		),
+	)
+	bar.SetPriority(2)
+	return bar
+}
+
+// newThreadBar 线程进度条, 显示块序号, 范围, 字节数与速度
 func (j *Job) newThreadBar(block *Block) *mpb.Bar {
+	name := fmt.Sprintf("#%d", block.index)
+	if block.seg == nil {
+		name += fmt.Sprintf(" %s-%s", FormatBytes(block.start), FormatBytes(block.end+1))
+	}
 	bar := j.progress.New(int64(block.end-block.start+1),
 		BarStyleSecondary,
+		mpb.PrependDecorators(
+			decor.Name(name, decor.WC{C: decor.DextraSpace}),
+		),
 		mpb.AppendDecorators(
-			decor.NewPercentage("%.1f"),
+			decor.CountersKibiByte("% .1f / % .1f"),
+			decor.EwmaSpeed(decor.SizeB1024(0), " % .1f", 30),
+			decor.NewPercentage(" %.1f"),
 		),
 		mpb.BarRemoveOnComplete(),
 	)
-	bar.SetPriority(2 + block.index)
+	bar.SetPriority(3 + block.index)
 	return bar
 }
 
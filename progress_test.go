@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+)
+
+// lockedBuffer 多个 reporter 并发写入
+type lockedBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func withProgress(t *testing.T, mode string) *lockedBuffer {
+	t.Helper()
+	m, i, out := progressMode, progressInterval, progressOut
+	t.Cleanup(func() { progressMode, progressInterval, progressOut, plainOutput = m, i, out, false })
+	if err := setupProgress(mode, 2); err != nil {
+		t.Fatal(err)
+	}
+	buf := &lockedBuffer{}
+	progressInterval, progressOut = 20*time.Millisecond, buf
+	return buf
+}
+
+func parseProgress(t *testing.T, buf *lockedBuffer) []progressLine {
+	t.Helper()
+	var lines []progressLine
+	s := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for s.Scan() {
+		var line progressLine
+		if err := json.Unmarshal(s.Bytes(), &line); err != nil {
+			t.Fatalf("%s: %v", s.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestProgressJSON(t *testing.T) {
+	setupDownload(t, 16*1024, 2)
+	buf := withProgress(t, PROGRESS_JSON)
+
+	data := randomData(blockSize*6 + 5)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond) // 保证有中间进度
+		http.ServeContent(w, r, "p.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	if err := (&Job{Url: srv.URL + "/p.bin"}).Run(); err != nil {
+		t.Fatal(err)
+	}
+	lines := parseProgress(t, buf)
+	if len(lines) < 3 {
+		t.Fatalf("lines: %d", len(lines))
+	}
+	var phases []string
+	for _, line := range lines {
+		if len(phases) == 0 || phases[len(phases)-1] != line.Phase {
+			phases = append(phases, line.Phase)
+		}
+		if line.Phase == "downloading" && (line.Total != int64(len(data)) || len(line.Blocks) != 7) {
+			t.Fatalf("downloading line: %+v", line)
+		}
+	}
+	for _, p := range []string{"probing", "downloading", "done"} {
+		if !slices.Contains(phases, p) {
+			t.Fatalf("phases %v missing %s", phases, p)
+		}
+	}
+	last := lines[len(lines)-1]
+	if last.Phase != "done" || last.Done != int64(len(data)) || last.Written != last.Done ||
+		last.Blocks != strings.Repeat("w", 7) || last.File != "p.bin" || last.Job == 0 {
+		t.Fatalf("last line: %+v", last)
+	}
+}
+
+func TestProgressJSONFailed(t *testing.T) {
+	setupDownload(t, 0, 0)
+	buf := withProgress(t, PROGRESS_JSON)
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	if err := (&Job{Url: srv.URL + "/missing.bin"}).Run(); err == nil {
+		t.Fatal("404 should fail")
+	}
+	lines := parseProgress(t, buf)
+	if last := lines[len(lines)-1]; last.Phase != "failed" || last.Error == "" || last.Total != -1 {
+		t.Fatalf("last line: %+v", last)
+	}
+}
+
+func TestProgressPlain(t *testing.T) {
+	defer func(b1, b2 bool) { showTotalProgressBar, showThreadProgressBar = b1, b2 }(showTotalProgressBar, showThreadProgressBar)
+	showTotalProgressBar, showThreadProgressBar = true, true
+	withProgress(t, PROGRESS_AUTO) // go test 的 stdout 不是终端
+	if progressMode != PROGRESS_PLAIN || showTotalProgressBar || showThreadProgressBar {
+		t.Fatalf("auto: %s", progressMode)
+	}
+	b, _ := (&LogFormat{}).Format(&log.Entry{Level: log.WarnLevel, Message: "hi"})
+	if !strings.HasPrefix(string(b), "[WARN][") || strings.Contains(string(b), "\x1b") {
+		t.Fatalf("plain log: %q", b)
+	}
+	if Hyperlink("/tmp/a") != "/tmp/a" {
+		t.Fatal("hyperlink should be plain")
+	}
+	if setupProgress("fancy", 2) == nil {
+		t.Fatal("unknown mode should be rejected")
+	}
+}
+
+func TestProgressBars(t *testing.T) {
+	setupDownload(t, 16*1024, 2)
+	showTotalProgressBar, showThreadProgressBar = true, true
+
+	data := randomData(blockSize*4 + 100)
+	var failed atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=16384-") && !failed.Swap(true) {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		http.ServeContent(w, r, "bars.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	out := &lockedBuffer{}
+	progress := mpb.New(mpb.WithOutput(out), mpb.WithWidth(120), mpb.WithAutoRefresh(), RefreshRate)
+	j := &Job{Url: srv.URL + "/bars.bin", shared: progress}
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	progress.Shutdown()
+
+	if j.retries.Load() != 1 || j.active.Load() != 0 || j.received.Load() != int64(len(data)) {
+		t.Fatalf("retries: %d, active: %d, received: %d", j.retries.Load(), j.active.Load(), j.received.Load())
+	}
+	screen := out.String()
+	for _, s := range []string{"Retries: 1", "#1 16.00 KiB-32.00 KiB", "KiB/s", "64.10 KiB / 64.10 KiB"} {
+		if !strings.Contains(screen, s) {
+			t.Errorf("progress output missing %q", s)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyConfig 代理规则, 未设置任何代理时回退到环境变量
+// HTTP_PROXY, HTTPS_PROXY, NO_PROXY
+type ProxyConfig struct {
+	All   *url.URL // 所有请求
+	HTTP  *url.URL // http:// 请求, 覆盖 All
+	HTTPS *url.URL // https:// 请求, 覆盖 All
+	Mega  *url.URL // MEGA API 请求, 覆盖以上
+
+	NoProxy []string // 直连的主机, 支持域名后缀, IP, CIDR 与 *
+}
+
+// Proxy 全局代理规则
+var Proxy = &ProxyConfig{}
+
+// ParseProxyURL 解析代理地址, "direct" 或 "none" 表示直连
+func ParseProxyURL(s string) (*url.URL, error) {
+	switch strings.ToLower(s) {
+	case "direct", "none":
+		return &url.URL{Scheme: "direct"}, nil
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing proxy host: %s", s)
+	}
+	return u, nil
+}
+
+// ParseNoProxy 解析逗号分隔的直连列表
+func ParseNoProxy(s string) []string {
+	var list []string
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			list = append(list, strings.ToLower(h))
+		}
+	}
+	return list
+}
+
+// For 选择请求使用的代理, nil 为直连
+func (c *ProxyConfig) For(req *http.Request) (*url.URL, error) {
+	host := req.URL.Hostname()
+	if c.noProxy(host) {
+		return nil, nil
+	}
+
+	var p *url.URL
+	switch {
+	case c.Mega != nil && host == megaApiHost:
+		p = c.Mega
+	case c.HTTPS != nil && req.URL.Scheme == "https":
+		p = c.HTTPS
+	case c.HTTP != nil && req.URL.Scheme == "http":
+		p = c.HTTP
+	case c.All != nil:
+		p = c.All
+	default:
+		return http.ProxyFromEnvironment(req)
+	}
+	if p.Scheme == "direct" {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func (c *ProxyConfig) noProxy(host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, np := range c.NoProxy {
+		if np == "*" {
+			return true
+		}
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(np); err == nil {
+				if cidr.Contains(ip) {
+					return true
+				}
+				continue
+			}
+			if npIP := net.ParseIP(np); npIP != nil && npIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		// 同 curl, ".example.com" 与 "example.com" 均匹配自身及子域名
+		np = strings.TrimPrefix(strings.TrimPrefix(np, "*"), ".")
+		if host == np || strings.HasSuffix(host, "."+np) {
+			return true
+		}
+	}
+	return false
+}
+
+var megaApiHost = strings.TrimPrefix(API_URL, "https://")
+
+type proxyCtxKey struct{}
+
+// withProxy 记录 RoundTrip 选定的代理, 供 Transport.Proxy 与 dialContext 读取
+func withProxy(ctx context.Context, p *url.URL) context.Context {
+	return context.WithValue(ctx, proxyCtxKey{}, p)
+}
+
+func proxyFromContext(ctx context.Context) *url.URL {
+	p, _ := ctx.Value(proxyCtxKey{}).(*url.URL)
+	return p
+}
+
+// httpProxy 用于 http.Transport.Proxy, socks 代理由 dialContext 处理
+func httpProxy(req *http.Request) (*url.URL, error) {
+	p := proxyFromContext(req.Context())
+	if p == nil || isSocks(p) {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func isSocks(p *url.URL) bool {
+	return p.Scheme == "socks5" || p.Scheme == "socks5h"
+}
+
+// dialSocks5 经 socks5 代理连接 addr,
+// socks5 在本地解析域名, socks5h 交由代理解析
+func dialSocks5(ctx context.Context, d *net.Dialer, proxy *url.URL, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no address for %s", host)
+		}
+		host = ips[0].IP.String()
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "1080")
+	}
+	conn, err := d.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err = socks5Handshake(conn, proxy.User, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 %s: %w", proxyAddr, err)
+	}
+	return conn, nil
+}
+
+var (
+	ErrSocksAuth    = errors.New("authentication failed")
+	ErrSocksNoAuth  = errors.New("no acceptable authentication method")
+	ErrSocksVersion = errors.New("unexpected protocol version")
+)
+
+// socks5Handshake RFC 1928 / RFC 1929
+func socks5Handshake(rw io.ReadWriter, user *url.Userinfo, host string, port int) error {
+	methods := []byte{0x00}
+	if user != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := rw.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(rw, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0x05 {
+		return ErrSocksVersion
+	}
+	switch buf[1] {
+	case 0x00:
+	case 0x02:
+		if user == nil {
+			return ErrSocksNoAuth
+		}
+		pass, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{0x01, byte(len(name))}
+		req = append(req, name...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := rw.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return ErrSocksAuth
+		}
+	default:
+		return ErrSocksNoAuth
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[0] != 0x05 {
+		return ErrSocksVersion
+	}
+	if resp[1] != 0x00 {
+		return fmt.Errorf("connect failed, reply code %d", resp[1])
+	}
+	var skip int
+	switch resp[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(rw, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("unknown address type %d", resp[3])
+	}
+	_, err := io.ReadFull(rw, make([]byte, skip+2)) // BND.ADDR, BND.PORT
+	return err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	reportFile    = "" // -report 输出的 JSON 文件
+	slowestBlocks = 3  // 报告中列出的最慢块数
+)
+
+// Report 任务结束后的统计
+type Report struct {
+	Url        string        `json:"url"`
+	FinalUrl   string        `json:"final_url,omitempty"`
+	Redirects  []string      `json:"redirects,omitempty"`
+	File       string        `json:"file,omitempty"`
+	Proto      string        `json:"proto,omitempty"`
+	Status     string        `json:"status"` // done, failed, canceled, paused
+	Error      string        `json:"error,omitempty"`
+	Size       int64         `json:"size"` // -1 为未知
+	Bytes      int64         `json:"bytes"`
+	Resumed    int64         `json:"resumed,omitempty"` // 续传前 .part 中已有的字节
+	Start      time.Time     `json:"start"`
+	WallTime   float64       `json:"wall_time"`   // 秒
+	AvgSpeed   float64       `json:"avg_speed"`   // 字节/秒
+	PeakSpeed  float64       `json:"peak_speed"`  // 最快的一秒
+	Conns      int32         `json:"connections"` // 新建的连接数
+	Retries    int32         `json:"retries"`
+	WriterWait float64       `json:"writer_wait"` // 秒, 顺序写入等待下一块的时间
+	WriteTime  float64       `json:"write_time"`  // 秒, 写入硬盘的时间
+	Checksums  []string      `json:"checksums,omitempty"`
+	Blocks     []BlockReport `json:"blocks,omitempty"`
+	Slowest    []int         `json:"slowest,omitempty"` // 最慢块的序号
+}
+
+// BlockReport 单个块的统计, 仅在下载成功时记录
+type BlockReport struct {
+	Index    int     `json:"index"`
+	Start    int     `json:"start"`
+	End      int     `json:"end"`
+	Duration float64 `json:"duration"` // 秒, 成功的那次请求
+	Retries  int     `json:"retries"`
+	Speed    float64 `json:"speed"`
+}
+
+// throughputSampler 按秒采样 received, 记录峰值速度
+type throughputSampler struct {
+	peak    float64
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func (j *Job) sampleThroughput() *throughputSampler {
+	s := &throughputSampler{stop: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		prev, last := j.received.Load(), time.Now()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case now := <-ticker.C:
+				cur := j.received.Load()
+				if speed := float64(cur-prev) / now.Sub(last).Seconds(); speed > s.peak {
+					s.peak = speed
+				}
+				prev, last = cur, now
+			}
+		}
+	}()
+	return s
+}
+
+func (s *throughputSampler) Stop() float64 {
+	close(s.stop)
+	<-s.stopped
+	return s.peak
+}
+
+// buildReport 汇总统计, 在 Clean 之后调用
+func (j *Job) buildReport(start time.Time, peak float64, err error) *Report {
+	wall := time.Since(start)
+	r := &Report{
+		Url:        redactUrl(j.Url),
+		FinalUrl:   redactUrl(j.getFinalUrl()),
+		File:       j.filePath,
+		Proto:      j.proto,
+		Size:       int64(j.size),
+		Bytes:      j.received.Load(),
+		Resumed:    j.resumed.Load(),
+		Start:      start,
+		WallTime:   wall.Seconds(),
+		Conns:      j.conns.Load(),
+		Retries:    j.retries.Load(),
+		WriterWait: time.Duration(j.writerWait.Load()).Seconds(),
+		WriteTime:  time.Duration(j.writeTime.Load()).Seconds(),
+		Checksums:  j.verified,
+	}
+	for _, u := range j.redirects {
+		r.Redirects = append(r.Redirects, redactUrl(u))
+	}
+	r.AvgSpeed = float64(r.Bytes) / max(wall.Seconds(), 0.001)
+	r.PeakSpeed = max(peak, r.AvgSpeed) // 不足一秒时没有采样
+
+	switch {
+	case err == context.Canceled:
+		r.Status = "canceled"
+	case j.phase.Load() == PHASE_PAUSED:
+		r.Status, r.Error = "paused", err.Error()
+	case err != nil:
+		r.Status, r.Error = "failed", err.Error()
+	case j.cleanErr != nil:
+		r.Status, r.Error = "failed", j.cleanErr.Error()
+	default:
+		r.Status = "done"
+	}
+	if r.Status != "done" {
+		r.File = ""
+	}
+
+	if err == nil && j.acceptRanges { // 失败时可能仍有协程在写块的统计
+		for _, block := range j.Blocks {
+			b := BlockReport{
+				Index:    block.index,
+				Start:    block.start,
+				End:      block.end,
+				Duration: block.took.Seconds(),
+				Retries:  block.retries,
+			}
+			if b.Duration > 0 {
+				b.Speed = float64(block.Written) / b.Duration
+			}
+			r.Blocks = append(r.Blocks, b)
+		}
+		slowest := slices.Clone(r.Blocks)
+		slices.SortStableFunc(slowest, func(a, b BlockReport) int {
+			switch {
+			case a.Duration > b.Duration:
+				return -1
+			case a.Duration < b.Duration:
+				return 1
+			}
+			return 0
+		})
+		for _, b := range slowest[:min(slowestBlocks, len(slowest))] {
+			r.Slowest = append(r.Slowest, b.Index)
+		}
+	}
+	return r
+}
+
+// logReport 打印摘要
+func (r *Report) logReport() {
+	if r.Status != "done" {
+		log.Infof("Transferred %s in %v over %s, %d connections, before %s",
+			FormatBytes(int(r.Bytes)), secs(r.WallTime), r.Proto, r.Conns, r.Status)
+		return
+	}
+	log.Infof("Downloaded %s in %v over %s: avg %s/s, peak %s/s, %d connections, %d retries",
+		FormatBytes(int(r.Bytes)), secs(r.WallTime), r.Proto,
+		FormatBytes(int(r.AvgSpeed)), FormatBytes(int(r.PeakSpeed)), r.Conns, r.Retries)
+	if len(r.Blocks) > 1 {
+		log.Infof("Writer waited %v for blocks, wrote for %v", secs(r.WriterWait), secs(r.WriteTime))
+		var slow []string
+		for _, i := range r.Slowest {
+			b := r.Blocks[i]
+			s := fmt.Sprintf("#%d %v (%s/s)", b.Index, secs(b.Duration), FormatBytes(int(b.Speed)))
+			if b.Retries > 0 {
+				s += fmt.Sprintf(" after %d retries", b.Retries)
+			}
+			slow = append(slow, s)
+		}
+		log.Infof("Slowest blocks: %s", strings.Join(slow, ", "))
+	}
+	if len(r.Redirects) > 0 {
+		log.Debugf("Redirects: %s -> %s", r.Url, strings.Join(r.Redirects, " -> "))
+	}
+}
+
+func secs(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond)
+}
+
+// writeReport 保存报告, v 为 *Report 或 Runner 的 []*Report
+func writeReport(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
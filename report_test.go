@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	setupDownload(t, 16*1024, 3)
+	defer func(f string) { reportFile = f }(reportFile)
+	reportFile = filepath.Join(t.TempDir(), "out.json")
+
+	data := randomData(blockSize*5 + 7)
+	var failed atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/latest":
+			http.Redirect(w, r, "/files/r.bin?v=2", http.StatusFound)
+			return
+		case strings.HasPrefix(r.Header.Get("Range"), "bytes=32768-") && !failed.Swap(true):
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		case strings.HasPrefix(r.Header.Get("Range"), "bytes=65536-"):
+			time.Sleep(200 * time.Millisecond) // 最慢的块
+		}
+		http.ServeContent(w, r, "r.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(data)
+	c, _ := ParseChecksum("sha256:" + hex.EncodeToString(sum[:]))
+	j := &Job{Url: srv.URL + "/latest", Checksum: c}
+	j.Start()
+
+	b, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != "done" || r.Bytes != int64(len(data)) || r.Size != r.Bytes || r.File != j.filePath {
+		t.Fatalf("report: %+v", r)
+	}
+	if len(r.Redirects) != 1 || !strings.Contains(r.FinalUrl, "/files/r.bin") {
+		t.Fatalf("redirects: %v, final: %s", r.Redirects, r.FinalUrl)
+	}
+	if r.Retries != 1 || len(r.Blocks) != 6 || r.Blocks[2].Retries != 1 || r.Slowest[0] != 4 {
+		t.Fatalf("retries: %d, blocks: %+v, slowest: %v", r.Retries, r.Blocks, r.Slowest)
+	}
+	if r.Blocks[4].Duration < 0.2 || r.PeakSpeed < r.AvgSpeed || r.WriterWait <= 0 {
+		t.Fatalf("timings: %+v", r)
+	}
+	if len(r.Checksums) != 1 || r.Checksums[0] != c.String() {
+		t.Fatalf("checksums: %v", r.Checksums)
+	}
+}
+
+func TestReportRunner(t *testing.T) {
+	setupDownload(t, 0, 0)
+	defer func(f string) { reportFile = f }(reportFile)
+	reportFile = filepath.Join(t.TempDir(), "out.json")
+
+	srv := newTestServer(t, "a.txt", []byte("hello"), time.Time{})
+	r := &Runner{Parallel: 2}
+	r.Add(&Job{Url: srv.URL + "/a.txt"})
+	r.Add(&Job{Url: "http://127.0.0.1:1/missing"})
+	if failed := r.Run(); failed != 1 {
+		t.Fatalf("failed: %d", failed)
+	}
+
+	b, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []Report
+	if err := json.Unmarshal(b, &reports); err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0].Status != "done" || reports[1].Status != "failed" || reports[1].Error == "" {
+		t.Fatalf("reports: %+v", reports)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resumeState 磁盘已满暂停时写在 .part 旁, 下次下载同一文件时据此续传
+type resumeState struct {
+	Url          string    `json:"url"`
+	Size         int       `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified,omitempty"`
+	BlockSize    int       `json:"block_size"`
+	Offset       int64     `json:"offset"` // 已按顺序写入的字节, 之后的内容作废
+	Paused       time.Time `json:"paused"`
+}
+
+func resumePath(partPath string) string {
+	return partPath + ".resume"
+}
+
+// partDir .part 所在目录, 设置了 -tmp 时在临时目录中
+func (j *Job) partDir() string {
+	dir := DownloadsFolder
+	if TempFolder != "" {
+		dir = TempFolder
+	}
+	return filepath.Join(dir, j.SubDir) // 同时下载的同名文件不冲突
+}
+
+// resumable 按块顺序写入且大小已知时才能从中途继续
+func (j *Job) resumable() bool {
+	return j.acceptRanges && j.size > 0 && j.segments == nil
+}
+
+func (j *Job) blockLen() int {
+	if j.blockSize > 0 {
+		return j.blockSize
+	}
+	return blockSize
+}
+
+// writtenOffset 开头连续写入的字节数
+func (j *Job) writtenOffset() int64 {
+	var offset int64
+	for _, block := range j.Blocks {
+		if block.Written == 0 {
+			break
+		}
+		offset += block.Written
+	}
+	return offset
+}
+
+// checkSpace 确认 .part 与下载目录的剩余空间放得下还未写入的部分,
+// 多文件来源拆分时 .part 仍在, 下载目录还要放下完整的一份
+func (j *Job) checkSpace() error {
+	if j.size <= 0 {
+		return nil
+	}
+	type space struct {
+		dir  string
+		need int64
+	}
+	checks := []space{{filepath.Dir(j.partPath), int64(j.size) - j.resumed.Load()}}
+	switch {
+	case j.files != nil && TempFolder == "":
+		checks[0].need += int64(j.size)
+	case j.files != nil || TempFolder != "": // 跨文件系统时移动需要复制
+		checks = append(checks, space{DownloadsFolder, int64(j.size)})
+	}
+	for _, c := range checks {
+		free, err := DiskFree(c.dir)
+		if err != nil {
+			j.logger().Debugf("Failed to get free space of %s: %v", c.dir, err)
+			continue
+		}
+		if free < c.need {
+			j.diskFull = true // 续传的 .part 保留
+			return fmt.Errorf("%w in %s: need %s, only %s free (%s short)", ErrDiskFull, c.dir,
+				FormatBytes(int(c.need)), FormatBytes(int(free)), FormatBytes(int(c.need-free)))
+		}
+	}
+	return nil
+}
+
+// pause 磁盘已满时截断到最后一个完整写入的块并保存续传信息, 无法续传时返回 false
+func (j *Job) pause() bool {
+	if !j.diskFull || !j.resumable() {
+		return false
+	}
+	offset := j.writtenOffset()
+	if offset == 0 {
+		return false
+	}
+	if err := os.Truncate(j.partPath, offset); err != nil {
+		log.Errorf("Failed to truncate %s: %v", j.partPath, err)
+		return false
+	}
+	b, _ := json.MarshalIndent(&resumeState{
+		Url:          j.Url,
+		Size:         j.size,
+		ETag:         j.etag,
+		LastModified: j.lastModified,
+		BlockSize:    j.blockLen(),
+		Offset:       offset,
+		Paused:       time.Now(),
+	}, "", "  ")
+	if err := os.WriteFile(resumePath(j.partPath), append(b, '\n'), 0644); err != nil {
+		log.Errorf("Failed to save resume state: %v", err)
+		return false
+	}
+	j.setPhase(PHASE_PAUSED)
+	log.Warnf("Disk full, paused with %s of %s written to %s; free up space and run again to resume",
+		FormatBytes(int(offset)), FormatBytes(j.size), j.partPath)
+	return true
+}
+
+// resume 打开暂停时留下的 .part (同名冲突时为 name(1).part), 没有可用的续传信息时返回 false
+func (j *Job) resume(dir string) bool {
+	if !j.resumable() {
+		return false
+	}
+	for _, partPath := range pausedParts(dir, j.fileName) {
+		if j.resumeFrom(partPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// pausedParts dir 中留有续传信息的 name.part 与 name(N).part, 同 GetUniqueFilePath 的命名
+func pausedParts(dir, name string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var res []string
+	for _, e := range entries {
+		part, ok := strings.CutSuffix(e.Name(), ".part.resume")
+		if !ok {
+			continue
+		}
+		n, ok := strings.CutPrefix(part, name)
+		if !ok {
+			continue
+		}
+		if n != "" {
+			i, ok := strings.CutPrefix(n, "(")
+			i, ok2 := strings.CutSuffix(i, ")")
+			if _, err := strconv.Atoi(i); !ok || !ok2 || err != nil {
+				continue
+			}
+		}
+		res = append(res, filepath.Join(dir, part+".part"))
+	}
+	return res
+}
+
+// resumeFrom 校验续传信息后从 partPath 继续, 同一 URL 但已失效的 .part 与续传信息被删除
+func (j *Job) resumeFrom(partPath string) bool {
+	b, err := os.ReadFile(resumePath(partPath))
+	if err != nil {
+		return false
+	}
+	var st resumeState
+	if err := json.Unmarshal(b, &st); err != nil {
+		log.Warnf("Removing invalid resume state %s: %v", resumePath(partPath), err)
+		discardPart(partPath)
+		return false
+	}
+	if st.Url != j.Url { // 另一个同名文件的
+		return false
+	}
+	if st.Size != j.size || st.ETag != j.etag || !st.LastModified.Equal(j.lastModified) ||
+		st.BlockSize != j.blockLen() || st.Offset <= 0 || st.Offset%int64(st.BlockSize) != 0 {
+		log.Infof("Remote file changed since %s was paused, starting over", partPath)
+		discardPart(partPath)
+		return false
+	}
+	fs, err := os.OpenFile(partPath, os.O_RDWR, 0)
+	if err != nil {
+		log.Warnf("Failed to open paused %s, starting over: %v", partPath, err)
+		discardPart(partPath)
+		return false
+	}
+	if info, err := fs.Stat(); err != nil || info.Size() < st.Offset {
+		fs.Close()
+		log.Warnf("%s is shorter than its resume state, starting over", partPath)
+		discardPart(partPath)
+		return false
+	}
+	if err := fs.Truncate(st.Offset); err != nil {
+		fs.Close()
+		return false
+	}
+	if _, err := fs.Seek(st.Offset, io.SeekStart); err != nil {
+		fs.Close()
+		return false
+	}
+
+	for _, block := range j.Blocks {
+		if int64(block.end) < st.Offset {
+			block.Written = int64(block.end - block.start + 1)
+			block.state.Store(BLOCK_WRITTEN)
+		}
+	}
+	j.fs, j.partPath = fs, partPath
+	j.resumed.Store(st.Offset)
+	log.Infof("Resuming %s from %s", partPath, FormatBytes(int(st.Offset)))
+	return true
+}
+
+// discardPart 删除失效的 .part 与续传信息
+func discardPart(partPath string) {
+	os.Remove(partPath)
+	os.Remove(resumePath(partPath))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckSpaceShortfall(t *testing.T) {
+	setupDownload(t, 1<<30, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(1<<50)) // 1 PiB
+		if r.Method == http.MethodGet {
+			t.Error("download should not start")
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := DiskFree(DownloadsFolder); err != nil {
+		t.Skip(err)
+	}
+	j := &Job{Url: srv.URL + "/huge.iso"}
+	err := j.Run()
+	if !errors.Is(err, ErrDiskFull) || !strings.Contains(err.Error(), "short") {
+		t.Fatalf("want shortfall error, got %v", err)
+	}
+	if entries, _ := os.ReadDir(DownloadsFolder); len(entries) != 0 {
+		t.Fatalf("files left behind: %v", entries)
+	}
+}
+
+func TestCheckSpaceSplitFiles(t *testing.T) {
+	setupDownload(t, 1<<30, 0)
+	free, err := DiskFree(DownloadsFolder)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// 放得下一份, 放不下拆分时的两份
+	j := &Job{size: int(free / 3 * 2), partPath: filepath.Join(DownloadsFolder, "t.part")}
+	if err := j.checkSpace(); err != nil {
+		t.Fatal(err)
+	}
+	j.files = []sourceFile{{path: "a", length: j.size}}
+	if err := j.checkSpace(); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("want disk full for split files, got %v", err)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	setupDownload(t, 16*1024, 4)
+
+	data := randomData(blockSize*5 + 100)
+	var fromStart atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			fromStart.Add(1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "r.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	pauseAfterTwoBlocks(t, srv.URL+"/r.bin", data)
+
+	j := &Job{Url: srv.URL + "/r.bin"}
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if j.report.Resumed != int64(blockSize*2) || j.report.Bytes != int64(len(data)-blockSize*2) || fromStart.Load() != 0 {
+		t.Fatalf("resumed %d, downloaded %d, requests from start: %d", j.report.Resumed, j.report.Bytes, fromStart.Load())
+	}
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "r.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("content mismatch: %v", err)
+	}
+	if entries, _ := os.ReadDir(DownloadsFolder); len(entries) != 1 {
+		t.Fatalf("leftovers: %v", entries)
+	}
+}
+
+// pauseAfterTwoBlocks 写完两块后第三块写了一半时磁盘满, 返回暂停的 .part
+func pauseAfterTwoBlocks(t *testing.T, url string, data []byte) string {
+	t.Helper()
+	j := &Job{Url: url}
+	if err := j.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	j.createFile()
+	for _, block := range j.Blocks[:2] {
+		n, _ := j.fs.Write(data[block.start : block.end+1])
+		block.Written = int64(n)
+	}
+	j.fs.Write(data[blockSize*2 : blockSize*2+100])
+	j.diskFull = true
+	partPath := j.partPath
+	j.Clean()
+	if j.phase.Load() != PHASE_PAUSED {
+		t.Fatalf("phase: %s", phaseNames[j.phase.Load()])
+	}
+	if info, err := os.Stat(partPath); err != nil || info.Size() != int64(blockSize*2) {
+		t.Fatalf("part file: %v, %v", info, err)
+	}
+	if _, err := os.Stat(resumePath(partPath)); err != nil {
+		t.Fatal(err)
+	}
+	return partPath
+}
+
+func TestResumeRenamedPart(t *testing.T) {
+	setupDownload(t, 16*1024, 4)
+
+	data := randomData(blockSize*5 + 100)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(w, r, "r.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	// 同名的 .part 被占用, 暂停在 r.bin(1).part
+	busy := filepath.Join(DownloadsFolder, "r.bin.part")
+	os.WriteFile(busy, []byte("busy"), 0644)
+	partPath := pauseAfterTwoBlocks(t, srv.URL+"/r.bin", data)
+	if filepath.Base(partPath) != "r.bin(1).part" {
+		t.Fatalf("part: %s", partPath)
+	}
+	j := &Job{Url: srv.URL + "/r.bin"}
+	if err := j.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	j.createFile()
+	if j.partPath != partPath || j.resumed.Load() != int64(blockSize*2) {
+		t.Fatalf("resumed %s from %d", j.partPath, j.resumed.Load())
+	}
+	j.fs.Close()
+	j.fs = nil
+
+	// 远端文件变化后旧的 .part 与续传信息被删除
+	etag.Store(`"v2"`)
+	j = &Job{Url: srv.URL + "/r.bin"}
+	if err := j.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if j.resume(DownloadsFolder) {
+		t.Fatal("changed file should not resume")
+	}
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Fatalf("stale part kept: %v", err)
+	}
+	if _, err := os.Stat(resumePath(partPath)); !os.IsNotExist(err) {
+		t.Fatalf("stale resume state kept: %v", err)
+	}
+	if _, err := os.Stat(busy); err != nil {
+		t.Fatalf("unrelated part removed: %v", err)
+	}
+}
+
+func TestWriteDiskFull(t *testing.T) {
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	setupDownload(t, 16*1024, 4)
+
+	data := randomData(blockSize) // 只有一块, 下载协程都已退出
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "f.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	j := &Job{Url: srv.URL + "/f.bin"}
+	if err := j.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	j.createFile()
+	j.fs.Close()
+	j.fs = full
+	err = j.DownloadMultiThread(&sync.WaitGroup{}) // 写入失败时不应卡住
+	if !errors.Is(err, ErrDiskFull) || !j.diskFull {
+		t.Fatalf("want disk full, got %v", err)
+	}
+	if j.pause() { // 一块都没写入, 没有可续传的内容
+		t.Fatal("nothing to resume")
+	}
+	full.Close()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+var parallelJobs = 3 // Runner 同时下载的文件数
+
+// Runner 多个任务共用一个进度显示, 同时运行 Parallel 个, 失败的任务不询问重试
+type Runner struct {
+	Parallel int
+	Jobs     []*Job
+}
+
+func (r *Runner) Add(j *Job) {
+	r.Jobs = append(r.Jobs, j)
+}
+
+// Run 运行所有任务, 返回失败的任务数, Ctrl+C 取消全部
+func (r *Runner) Run() (failed int) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer stop()
+
+	progress := mpb.NewWithContext(ctx, RefreshRate)
+	var filesBar *mpb.Bar
+	if showTotalProgressBar {
+		filesBar = progress.New(int64(len(r.Jobs)),
+			BarStyleMain,
+			mpb.PrependDecorators(
+				decor.Name("Files: "),
+				decor.CountersNoUnit("%d / %d"),
+			),
+		)
+		filesBar.SetPriority(-1) // 置顶
+	}
+
+	limiter := make(chan struct{}, max(r.Parallel, 1))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, j := range r.Jobs {
+		select {
+		case limiter <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		j.parent, j.shared = ctx, progress
+		go func(j *Job) {
+			defer func() { <-limiter; wg.Done() }()
+			if err := j.Run(); err != nil {
+				log.Errorf("Failed to download %s: %v", redactUrl(j.Url), err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+			if filesBar != nil {
+				filesBar.Increment()
+			}
+		}(j)
+	}
+	wg.Wait()
+	if filesBar != nil {
+		filesBar.SetTotal(-1, true)
+	}
+	progress.Shutdown()
+
+	if skipped := len(r.Jobs) - countStarted(r.Jobs); skipped > 0 {
+		log.Warnf("Canceled, %d files not started", skipped)
+		failed += skipped
+	}
+	log.Infof("Downloaded %d of %d files", len(r.Jobs)-failed, len(r.Jobs))
+	if reportFile != "" {
+		reports := []*Report{}
+		for _, j := range r.Jobs {
+			if j.report != nil {
+				reports = append(reports, j.report)
+			}
+		}
+		if err := writeReport(reportFile, reports); err != nil {
+			log.Errorf("Failed to write report: %v", err)
+		}
+	}
+	return
+}
+
+func countStarted(jobs []*Job) (n int) {
+	for _, j := range jobs {
+		if j.parent != nil {
+			n++
+		}
+	}
+	return
+}
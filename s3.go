@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	s3Endpoint = "" // S3 兼容服务地址, 如 MinIO, 为空时使用 AWS_ENDPOINT_URL 或 AWS
+	s3Profile  = "" // ~/.aws 中的 profile, 为空时使用 AWS_PROFILE 或 default
+)
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Config 凭据, 区域与服务地址, 凭据为空时匿名访问
+type s3Config struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	endpoint     *url.URL // 为 nil 时使用 AWS 的虚拟主机地址
+}
+
+// loadS3Config 依次读取参数, 环境变量, ~/.aws/credentials 与 ~/.aws/config
+func loadS3Config() (*s3Config, error) {
+	c := &s3Config{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       os.Getenv("AWS_REGION"),
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	endpoint := s3Endpoint
+	for _, env := range []string{"AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"} {
+		if endpoint == "" {
+			endpoint = os.Getenv(env)
+		}
+	}
+
+	profile := s3Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	home, _ := os.UserHomeDir()
+	credFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credFile == "" && home != "" {
+		credFile = filepath.Join(home, ".aws", "credentials")
+	}
+	confFile := os.Getenv("AWS_CONFIG_FILE")
+	if confFile == "" && home != "" {
+		confFile = filepath.Join(home, ".aws", "config")
+	}
+
+	// config 中非 default 的节为 [profile name]
+	section := "profile " + profile
+	if profile == "default" {
+		section = profile
+	}
+	creds := parseIni(credFile)[profile]
+	conf := parseIni(confFile)[section]
+	if c.accessKey == "" {
+		c.accessKey, c.secretKey, c.sessionToken = creds["aws_access_key_id"], creds["aws_secret_access_key"], creds["aws_session_token"]
+	}
+	if c.accessKey == "" {
+		c.accessKey, c.secretKey, c.sessionToken = conf["aws_access_key_id"], conf["aws_secret_access_key"], conf["aws_session_token"]
+	}
+	if c.region == "" {
+		c.region = conf["region"]
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = conf["endpoint_url"]
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		c.endpoint = u
+	}
+	if c.accessKey == "" {
+		log.Debug("No S3 credentials found, sending anonymous requests")
+	}
+	return c, nil
+}
+
+// parseIni 解析 AWS 的 ini 文件, 节名 -> 键 -> 值, 读取失败时返回空
+func parseIni(p string) map[string]map[string]string {
+	res := map[string]map[string]string{}
+	f, err := os.Open(p)
+	if err != nil {
+		return res
+	}
+	defer f.Close()
+
+	var cur map[string]string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if res[name] == nil {
+				res[name] = map[string]string{}
+			}
+			cur = res[name]
+		case cur != nil:
+			if k, v, ok := strings.Cut(line, "="); ok {
+				cur[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+			}
+		}
+	}
+	return res
+}
+
+// objectUrl 自定义服务地址使用路径风格, AWS 使用虚拟主机风格
+func (c *s3Config) objectUrl(bucket, key string, query url.Values) string {
+	var u url.URL
+	if c.endpoint != nil {
+		u = *c.endpoint
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u = url.URL{Scheme: "https", Host: bucket + ".s3." + c.region + ".amazonaws.com", Path: "/" + key}
+	}
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+	return u.String()
+}
+
+// s3Signer 对发往服务地址的请求做 SigV4 签名
+type s3Signer struct {
+	*s3Config
+	host string
+	now  func() time.Time
+}
+
+// sign 签名 host, range 与 x-amz-* 头, GET/HEAD 无请求体
+func (s *s3Signer) sign(req *http.Request) {
+	if s.accessKey == "" || !strings.EqualFold(req.URL.Host, s.host) {
+		return
+	}
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	if req.Method == "HEAD" {
+		req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, true),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		emptySHA256,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, p := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, p)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.accessKey, scope, signed, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape SigV4 的 URI 编码, 只保留非保留字符
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	var parts []string
+	for k, vs := range q {
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// parseS3Url s3://bucket/key, key 为空或以 / 结尾时为前缀
+func parseS3Url(u *url.URL) (bucket, key string, err error) {
+	if u.Host == "" {
+		return "", "", fmt.Errorf("missing bucket in %s", u)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+func isS3Prefix(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	return err == nil && u.Scheme == "s3" && (u.Path == "" || strings.HasSuffix(u.Path, "/"))
+}
+
+// initS3 将 s3:// 换成服务地址, 之后按 HTTP 下载, 请求由 do 签名
+func (j *Job) initS3(u *url.URL) error {
+	bucket, key, err := parseS3Url(u)
+	if err != nil {
+		return err
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		return fmt.Errorf("%s is a prefix, not an object", u)
+	}
+	cfg, err := loadS3Config()
+	if err != nil {
+		return err
+	}
+	j.Url = cfg.objectUrl(bucket, key, nil)
+	nu, _ := url.Parse(j.Url)
+	j.s3 = &s3Signer{s3Config: cfg, host: nu.Host, now: time.Now}
+	return nil
+}
+
+// s3Object ListObjectsV2 中的一项
+type s3Object struct {
+	Key  string `xml:"Key"`
+	Size int    `xml:"Size"`
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+// listS3 列出前缀下的对象, 返回 s3:// 地址与相对前缀的子目录
+func listS3(ctx context.Context, rawUrl string, header http.Header) (urls, dirs []string, err error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	bucket, prefix, err := parseS3Url(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := loadS3Config()
+	if err != nil {
+		return nil, nil, err
+	}
+	base, _ := url.Parse(cfg.objectUrl(bucket, "", nil))
+	j := &Job{Header: header, s3: &s3Signer{s3Config: cfg, host: base.Host, now: time.Now}}
+
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := j.newRequest(ctx, "GET", cfg.objectUrl(bucket, "", q))
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := j.do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		var res s3ListResult
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("list %s: http status: %s", rawUrl, resp.Status)
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("list %s: %w", rawUrl, err)
+		}
+		for _, o := range res.Contents {
+			if strings.HasSuffix(o.Key, "/") { // 目录占位对象
+				continue
+			}
+			rel := strings.TrimPrefix(o.Key, prefix)
+			dir := path.Dir(rel)
+			if dir == "." {
+				dir = ""
+			}
+			if !filepath.IsLocal(filepath.FromSlash(rel)) {
+				log.Warnf("Skipping unsafe key %q", o.Key)
+				continue
+			}
+			urls = append(urls, "s3://"+bucket+"/"+o.Key)
+			dirs = append(dirs, filepath.FromSlash(dir))
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return urls, dirs, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// s3Checksum 对象的校验信息, 来自 HEAD 响应
+type s3Checksum struct {
+	etag      string
+	checksums map[string]string // 算法 -> base64, 分段上传时带 -N 后缀
+	encrypted bool              // SSE-KMS/SSE-C 的 ETag 不是 MD5
+}
+
+func parseS3Header(h http.Header) *s3Checksum {
+	c := &s3Checksum{etag: strings.Trim(h.Get("ETag"), `"`), checksums: map[string]string{}}
+	for _, algo := range []string{"sha256", "sha1", "crc32c", "crc32"} {
+		if v := h.Get("X-Amz-Checksum-" + algo); v != "" {
+			c.checksums[algo] = v
+		}
+	}
+	sse := h.Get("X-Amz-Server-Side-Encryption")
+	c.encrypted = strings.HasPrefix(sse, "aws:kms") || h.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != ""
+	return c
+}
+
+func s3Hash(algo string) hash.Hash {
+	switch algo {
+	case "sha256":
+		return sha256.New()
+	case "sha1":
+		return sha1.New()
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "crc32":
+		return crc32.NewIEEE()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// verifyS3 用 x-amz-checksum-* 或 ETag 校验,
+// 分段上传的值为各段摘要拼接后的摘要加 -N, 段大小由 HEAD ?partNumber=1 得到
+func (j *Job) verifyS3(p string) error {
+	c := j.s3sum
+	if c == nil {
+		return nil
+	}
+	algo, want := "", ""
+	for _, a := range []string{"sha256", "sha1", "crc32c", "crc32"} {
+		if v, ok := c.checksums[a]; ok {
+			algo, want = a, v
+			break
+		}
+	}
+	etag := false
+	if algo == "" {
+		if c.encrypted || !isETagMD5(c.etag) {
+			log.Debugf("No verifiable S3 checksum (ETag: %s)", c.etag)
+			return nil
+		}
+		algo, want, etag = "md5", c.etag, true
+	}
+
+	value, parts, multipart := strings.Cut(want, "-")
+	var sum []byte
+	var err error
+	if multipart {
+		n, err := strconv.Atoi(parts)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid S3 checksum %q", want)
+		}
+		partSize, err := j.s3PartSize()
+		if err != nil {
+			return fmt.Errorf("part size: %w", err)
+		}
+		sum, err = hashParts(p, algo, partSize, n)
+		if err != nil {
+			return err
+		}
+	} else if sum, err = hashParts(p, algo, 0, 1); err != nil {
+		return err
+	}
+
+	got := base64.StdEncoding.EncodeToString(sum)
+	if etag {
+		got = hex.EncodeToString(sum)
+	}
+	if got != value {
+		return fmt.Errorf("S3 %s mismatch: expected %s, got %s", algo, want, got)
+	}
+	log.Infof("S3 %s verified: %s", algo, want)
+	j.verified = append(j.verified, "s3-"+algo+":"+want)
+	return nil
+}
+
+func isETagMD5(etag string) bool {
+	value, parts, multipart := strings.Cut(etag, "-")
+	if _, err := hex.DecodeString(value); err != nil || len(value) != 32 {
+		return false
+	}
+	if multipart {
+		_, err := strconv.Atoi(parts)
+		return err == nil
+	}
+	return true
+}
+
+// hashParts partSize 为 0 时是整个文件的摘要, 否则是各段摘要拼接后的摘要
+func hashParts(p, algo string, partSize, n int) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if partSize == 0 {
+		h := s3Hash(algo)
+		if _, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	outer := s3Hash(algo)
+	for i := 0; i < n; i++ {
+		h := s3Hash(algo)
+		written, err := io.Copy(h, io.LimitReader(f, int64(partSize)))
+		if err != nil {
+			return nil, err
+		}
+		if written == 0 {
+			return nil, errors.New("file shorter than the part count")
+		}
+		outer.Write(h.Sum(nil))
+	}
+	if extra, _ := io.Copy(io.Discard, f); extra > 0 {
+		return nil, errors.New("file longer than the part count")
+	}
+	return outer.Sum(nil), nil
+}
+
+// s3PartSize 第一段的大小, 除最后一段外各段相同
+func (j *Job) s3PartSize() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	u, err := url.Parse(j.getFinalUrl())
+	if err != nil {
+		return 0, err
+	}
+	q := u.Query()
+	q.Set("partNumber", "1")
+	u.RawQuery = canonicalQuery(q)
+	req, err := j.newRequest(ctx, "HEAD", u.String())
+	if err != nil {
+		return 0, err
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("http status: %s", resp.Status)
+	}
+	if resp.ContentLength <= 0 {
+		return 0, errors.New("missing Content-Length")
+	}
+	return int(resp.ContentLength), nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	sshKeyFile     string                    // 私钥, 为空时尝试 ~/.ssh/id_*
+	knownHostsFile = defaultKnownHostsFile() // 主机密钥校验
+)
+
+func defaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// SftpSource sftp://user@host/path, 共用一条 SSH 连接,
+// 每个块打开独立的文件句柄, 以 ReadAt 并发读取
+type SftpSource struct {
+	addr     string
+	user     string
+	password string
+	path     string
+
+	gotConn func() // 建立 SSH 连接时调用, 用于统计连接数
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func NewSftpSource(u *url.URL, auth *Auth) *SftpSource {
+	s := &SftpSource{
+		path: u.Path,
+	}
+	if p, ok := strings.CutPrefix(s.path, "/~/"); ok { // 同 curl, 相对于家目录
+		s.path = p
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+
+	switch {
+	case u.User != nil:
+		s.user = u.User.Username()
+		s.password, _ = u.User.Password()
+	case auth != nil && auth.User != "":
+		s.user, s.password = auth.User, auth.Password
+	default:
+		if cur, err := user.Current(); err == nil {
+			s.user = cur.Username
+		}
+	}
+	return s
+}
+
+// signers 私钥文件与 ssh-agent 中的密钥
+func (s *SftpSource) signers() (signers []ssh.Signer, closeAgent func()) {
+	closeAgent = func() {}
+
+	files := []string{sshKeyFile}
+	if sshKeyFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				files = append(files, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		pem, err := os.ReadFile(f)
+		if err != nil {
+			if f == sshKeyFile || !os.IsNotExist(err) {
+				log.Warnf("Failed to read SSH key: %v", err)
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			var missing *ssh.PassphraseMissingError
+			if errors.As(err, &missing) {
+				log.Debugf("Skipping encrypted SSH key %s, load it into ssh-agent instead", f)
+			} else {
+				log.Warnf("Failed to parse SSH key %s: %v", f, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			log.Debugf("Failed to connect to ssh-agent: %v", err)
+			return
+		}
+		closeAgent = func() { conn.Close() }
+		agentSigners, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			log.Debugf("Failed to list ssh-agent keys: %v", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+	return
+}
+
+// connect 建立或复用 SSH 连接
+func (s *SftpSource) connect(ctx context.Context) (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	if knownHostsFile == "" {
+		return nil, errors.New("sftp: no known_hosts file to verify host key")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+	signers, closeAgent := s.signers()
+	defer closeAgent()
+
+	config := &ssh.ClientConfig{
+		User: s.user,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signers...),
+		},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}
+	if s.password != "" {
+		config.Auth = append(config.Auth, ssh.Password(s.password))
+	}
+
+	d := &net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.gotConn != nil {
+		s.gotConn()
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.addr, config)
+	if !stop() && err == nil {
+		err = ctx.Err()
+		c.Close()
+	}
+	if err != nil {
+		conn.Close()
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("sftp: host %s not in %s, add it with ssh-keyscan", s.addr, knownHostsFile)
+		}
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+
+	sshClient := ssh.NewClient(c, chans, reqs)
+	client, err := sftp.NewClient(sshClient, sftp.UseConcurrentReads(true))
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("sftp: %w", err)
+	}
+	s.conn, s.client = sshClient, client
+	return client, nil
+}
+
+// reset 丢弃失效的连接, 下次重新建立
+func (s *SftpSource) reset(client *sftp.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == client {
+		s.client.Close()
+		s.conn.Close()
+		s.conn, s.client = nil, nil
+	}
+}
+
+func (s *SftpSource) Stat(ctx context.Context) (info sourceInfo, err error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return
+	}
+	fi, err := client.Stat(s.path)
+	if err != nil {
+		return info, fmt.Errorf("sftp: %s: %w", s.path, err)
+	}
+	if fi.IsDir() {
+		return info, fmt.Errorf("sftp: %s is a directory", s.path)
+	}
+	info.name = path.Base(s.path)
+	info.size = int(fi.Size())
+	info.modTime = fi.ModTime()
+	info.acceptRanges = fi.Mode().IsRegular()
+	return
+}
+
+func (s *SftpSource) OpenRange(ctx context.Context, start, end int) (io.ReadCloser, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(s.path)
+	if err != nil {
+		var status *sftp.StatusError
+		if ctx.Err() == nil && !errors.As(err, &status) {
+			s.reset(client) // 连接已断开
+		}
+		return nil, fmt.Errorf("sftp: %s: %w", s.path, err)
+	}
+
+	var r io.Reader
+	if end < 0 {
+		if _, err = f.Seek(int64(start), io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = f
+	} else {
+		r = io.NewSectionReader(f, int64(start), int64(end-start+1))
+	}
+	stop := context.AfterFunc(ctx, func() {
+		if context.Cause(ctx) == ErrStalled { // 请求不再返回, 只能断开整条连接
+			s.reset(client)
+		}
+		f.Close()
+	})
+	return &sftpReader{Reader: r, f: f, stop: stop}, nil
+}
+
+// Close 断开连接, 交互式重试时再次使用会重新连接
+func (s *SftpSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		s.client.Close()
+		s.conn.Close()
+		s.conn, s.client = nil, nil
+	}
+	return nil
+}
+
+type sftpReader struct {
+	io.Reader
+	f    *sftp.File
+	stop func() bool
+}
+
+func (r *sftpReader) Close() error {
+	r.stop()
+	return r.f.Close()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpTestFS 只读的单文件 sftp 服务, 统计并发 ReadAt
+type sftpTestFS struct {
+	name      string
+	data      []byte
+	modTime   time.Time
+	active    atomic.Int32
+	maxActive atomic.Int32
+}
+
+type sftpTestFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi sftpTestFileInfo) Name() string       { return fi.name }
+func (fi sftpTestFileInfo) Size() int64        { return fi.size }
+func (fi sftpTestFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi sftpTestFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi sftpTestFileInfo) IsDir() bool        { return false }
+func (fi sftpTestFileInfo) Sys() any           { return nil }
+
+type sftpTestLister []os.FileInfo
+
+func (l sftpTestLister) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *sftpTestFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if r.Filepath != f.name {
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+func (f *sftpTestFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if r.Filepath != f.name {
+		return nil, os.ErrNotExist
+	}
+	return sftpTestLister{sftpTestFileInfo{path.Base(f.name), int64(len(f.data)), f.modTime}}, nil
+}
+
+func (f *sftpTestFS) ReadAt(p []byte, off int64) (int, error) {
+	n := f.active.Add(1)
+	defer f.active.Add(-1)
+	for {
+		m := f.maxActive.Load()
+		if n <= m || f.maxActive.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond) // 让并发读取重叠
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+// newSftpTestServer 返回监听地址, 接受 clientKey 公钥或 password 登录
+func newSftpTestServer(t *testing.T, hostKey ssh.Signer, clientKey ssh.PublicKey, password string, fsys *sftpTestFS) string {
+	t.Helper()
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if clientKey != nil && bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PasswordCallback: func(_ ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if password != "" && string(pass) == password {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	mem := sftp.InMemHandler()
+	handlers := sftp.Handlers{FileGet: fsys, FilePut: mem.FilePut, FileCmd: mem.FileCmd, FileList: fsys}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					c.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					if nc.ChannelType() != "session" {
+						nc.Reject(ssh.UnknownChannelType, "session only")
+						continue
+					}
+					ch, reqs, err := nc.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						for req := range reqs {
+							ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+							req.Reply(ok, nil)
+							if ok {
+								go func() {
+									sftp.NewRequestServer(ch, handlers).Serve()
+									ch.Close()
+								}()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newSSHKey(t *testing.T) (ssh.Signer, []byte) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(block)
+}
+
+// useSSH 指定私钥与 known_hosts, 屏蔽本机 ssh-agent
+func useSSH(t *testing.T, keyFile, knownHosts string) {
+	t.Helper()
+	oldKey, oldHosts := sshKeyFile, knownHostsFile
+	sshKeyFile, knownHostsFile = keyFile, knownHosts
+	t.Setenv("SSH_AUTH_SOCK", "")
+	t.Cleanup(func() { sshKeyFile, knownHostsFile = oldKey, oldHosts })
+}
+
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSftpDownload(t *testing.T) {
+	setupDownload(t, 64*1024, 4)
+
+	hostKey, _ := newSSHKey(t)
+	clientKey, clientPEM := newSSHKey(t)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, clientPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := &sftpTestFS{
+		name:    "/srv/build/artifact.tar",
+		data:    randomData(blockSize*6 + 99),
+		modTime: time.Date(2024, 10, 2, 11, 33, 1, 0, time.UTC),
+	}
+	addr := newSftpTestServer(t, hostKey, clientKey.PublicKey(), "", fsys)
+	useSSH(t, keyFile, writeKnownHosts(t, addr, hostKey.PublicKey()))
+
+	j := &Job{Url: "sftp://builder@" + addr + fsys.name}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "artifact.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fsys.data) {
+		t.Fatal("content mismatch")
+	}
+	fi, _ := os.Stat(j.filePath)
+	if !fi.ModTime().Equal(fsys.modTime) {
+		t.Fatalf("mtime: %v, want %v", fi.ModTime(), fsys.modTime)
+	}
+	if n := fsys.maxActive.Load(); n < 2 {
+		t.Fatalf("max concurrent ReadAt: %d, want parallel", n)
+	}
+	if n := j.conns.Load(); n != 1 {
+		t.Fatalf("SSH connections: %d, want 1", n)
+	}
+
+	// 交互式重试复用同一个 source, Clean 断开后重新连接
+	if err := j.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.download(); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if got, _ := os.ReadFile(j.filePath); !bytes.Equal(got, fsys.data) {
+		t.Fatal("retry content mismatch")
+	}
+}
+
+func TestSftpPassword(t *testing.T) {
+	hostKey, _ := newSSHKey(t)
+	fsys := &sftpTestFS{name: "/file.bin", data: []byte("hello")}
+	addr := newSftpTestServer(t, hostKey, nil, "secret", fsys)
+	useSSH(t, filepath.Join(t.TempDir(), "missing"), writeKnownHosts(t, addr, hostKey.PublicKey()))
+
+	j := &Job{Url: "sftp://builder:secret@" + addr + "/file.bin"}
+	if err := j.init(); err != nil && err != ErrNotAcceptRanges {
+		t.Fatal(err)
+	}
+	defer j.source.Close()
+	if j.size != 5 || j.fileName != "file.bin" {
+		t.Fatalf("size: %d, name: %s", j.size, j.fileName)
+	}
+	if strings.Contains(j.getFinalUrl(), "secret") {
+		t.Fatalf("password leaked: %s", j.getFinalUrl())
+	}
+}
+
+func TestSftpHostKeyVerification(t *testing.T) {
+	hostKey, _ := newSSHKey(t)
+	otherKey, _ := newSSHKey(t)
+	clientKey, clientPEM := newSSHKey(t)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	os.WriteFile(keyFile, clientPEM, 0600)
+
+	fsys := &sftpTestFS{name: "/file.bin", data: []byte("hello")}
+	addr := newSftpTestServer(t, hostKey, clientKey.PublicKey(), "", fsys)
+
+	for name, knownHosts := range map[string]string{
+		"mismatch": writeKnownHosts(t, addr, otherKey.PublicKey()),
+		"unknown":  writeKnownHosts(t, "example.com:22", hostKey.PublicKey()),
+	} {
+		useSSH(t, keyFile, knownHosts)
+		j := &Job{Url: "sftp://builder@" + addr + "/file.bin"}
+		err := j.init()
+		j.source.Close()
+		if err == nil || err == ErrNotAcceptRanges {
+			t.Fatalf("%s: host key accepted", name)
+		}
+	}
+}
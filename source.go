@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rangeSource 非 HTTP 来源, 按字节范围读取, 复用 Blocks 与顺序写入
+type rangeSource interface {
+	// Stat 文件名, 大小 (-1 为未知), 修改时间, 是否支持范围读取
+	Stat(ctx context.Context) (info sourceInfo, err error)
+	// OpenRange 读取 [start, end] 闭区间, end 为 -1 时读到结尾
+	OpenRange(ctx context.Context, start, end int) (io.ReadCloser, error)
+	// Close 释放连接, 可重复调用
+	Close() error
+}
+
+type sourceInfo struct {
+	name         string
+	size         int
+	modTime      time.Time
+	acceptRanges bool
+	blockSize    int          // 块需要按来源对齐时指定, 如 torrent 的 piece
+	files        []sourceFile // 多文件来源, 完成后从 .part 拆分
+}
+
+// sourceFile 多文件来源中的一个文件, offset 为其在 .part 中的位置
+type sourceFile struct {
+	path   string // 相对路径
+	offset int
+	length int
+}
+
+// statSource 代替 fetchHeader
+func (j *Job) statSource() error {
+	ctx, cancel := context.WithTimeout(j.ctx, time.Second*30)
+	defer cancel()
+
+	info, err := j.source.Stat(ctx)
+	if err != nil {
+		return err
+	}
+	j.setFinalUrl(redactUrl(j.Url))
+	j.fileName = info.name
+	j.size = info.size
+	j.lastModified = info.modTime
+	j.acceptRanges = info.acceptRanges
+	j.blockSize = info.blockSize
+	j.files = info.files
+	return j.checkSize()
+}
+
+// splitFiles 将 .part 按文件列表拆分到 dir
+func splitFiles(partPath, dir string, files []sourceFile) error {
+	src, err := os.Open(partPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	for _, f := range files {
+		p := filepath.Join(dir, f.path)
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		dst, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(dst, io.NewSectionReader(src, int64(f.offset), int64(f.length)))
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// DiskFree 路径所在文件系统的可用字节数, 仅支持 Linux, macOS 与 Windows
+func DiskFree(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// isDiskFull 写入失败是否因为磁盘已满
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// DiskFree 路径所在文件系统对当前用户可用的字节数
+func DiskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// isDiskFull 写入失败是否因为磁盘已满
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
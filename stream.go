@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// streamVariant 选择的码率: 空/best 最高, worst 最低, 720p 按高度, 数字为带宽上限
+var streamVariant string
+
+const maxPlaylistSize = 16 * 1024 * 1024
+
+// segment HLS/DASH 分段, 每段对应一个块
+type segment struct {
+	url   string
+	start int // 字节范围, end 为 -1 时为整个分段
+	end   int
+	key   *segmentKey
+	iv    []byte
+}
+
+// segmentKey AES-128 密钥, 同一密钥的分段共用, 首次使用时下载
+type segmentKey struct {
+	url string
+	mu  sync.Mutex
+	key []byte
+}
+
+// variant 可选的码率
+type variant struct {
+	url       string
+	bandwidth int
+	width     int
+	height    int
+}
+
+// isStreamType 按 Content-Type 判断播放列表类型
+func isStreamType(contentType string) int {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch strings.ToLower(mt) {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl":
+		return SRC_HLS
+	case "application/dash+xml":
+		return SRC_DASH
+	}
+	return SRC_NORMAL
+}
+
+// initStream 解析播放列表, 代替 fetchHeader
+func (j *Job) initStream() error {
+	j.closeProbe()
+	ctx, cancel := context.WithTimeout(j.ctx, time.Second*30)
+	defer cancel()
+
+	var (
+		segs []*segment
+		ext  string
+		err  error
+	)
+	switch j.src {
+	case SRC_HLS:
+		segs, ext, err = j.loadHLS(ctx, j.Url)
+	case SRC_DASH:
+		segs, ext, err = j.loadDASH(ctx, j.Url)
+	}
+	if err != nil {
+		return err
+	}
+	if len(segs) == 0 {
+		return ErrNothingToDownload
+	}
+
+	u, _ := url.Parse(j.getFinalUrl())
+	name := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+	if name == "" || name == "." || name == "/" {
+		name = "stream"
+	}
+	j.fileName = name + ext
+	j.segments = segs
+	j.size = -1
+	j.acceptRanges = true
+	log.Infof("%d segments", len(segs))
+	return nil
+}
+
+// fetchPlaylist 下载播放列表, 返回内容与重定向后的地址
+func (j *Job) fetchPlaylist(ctx context.Context, rawUrl string) ([]byte, *url.URL, error) {
+	req, err := j.newRequest(withRedirectLog(ctx, &j.redirects), "GET", rawUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("playlist %s: http status: %s", redactUrl(rawUrl), resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPlaylistSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	j.setFinalUrl(resp.Request.URL.String())
+	j.proto = resp.Proto
+	return body, resp.Request.URL, nil
+}
+
+// pickVariant 按 streamVariant 选择, 返回下标
+func pickVariant(vs []variant, want string) (int, error) {
+	if len(vs) == 0 {
+		return -1, errors.New("no variants")
+	}
+	idx := make([]int, len(vs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return vs[idx[a]].bandwidth < vs[idx[b]].bandwidth })
+
+	want = strings.ToLower(strings.TrimSpace(want))
+	switch {
+	case want == "" || want == "best":
+		return idx[len(idx)-1], nil
+	case want == "worst":
+		return idx[0], nil
+	case strings.HasSuffix(want, "p"):
+		h, err := strconv.Atoi(strings.TrimSuffix(want, "p"))
+		if err != nil {
+			break
+		}
+		for i := len(idx) - 1; i >= 0; i-- {
+			if vs[idx[i]].height == h {
+				return idx[i], nil
+			}
+		}
+		return -1, fmt.Errorf("no %dp variant", h)
+	default:
+		bw, err := strconv.Atoi(want)
+		if err != nil {
+			break
+		}
+		for i := len(idx) - 1; i >= 0; i-- {
+			if vs[idx[i]].bandwidth <= bw {
+				return idx[i], nil
+			}
+		}
+		return idx[0], nil
+	}
+	return -1, fmt.Errorf("invalid variant %q, want best, worst, <height>p or bandwidth", want)
+}
+
+// openSegment 请求分段, 带字节范围时只接受 206
+func (j *Job) openSegment(ctx context.Context, block *Block) (io.ReadCloser, error) {
+	seg := block.seg
+	req, err := j.newRequest(ctx, "GET", seg.url)
+	if err != nil {
+		return nil, err
+	}
+	if seg.end >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.start, seg.end))
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && seg.end >= 0:
+	case resp.StatusCode == http.StatusOK && seg.end < 0:
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("segment %d: http status: %s", block.index, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// decryptSegment AES-128-CBC 解密块, 去除 PKCS#7 填充
+func (j *Job) decryptSegment(ctx context.Context, block *Block) error {
+	seg := block.seg
+	key, err := j.segmentKey(ctx, seg.key)
+	if err != nil {
+		return err
+	}
+	data := block.Bytes()
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return fmt.Errorf("segment %d: encrypted size %d is not a multiple of the block size", block.index, len(data))
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	cipher.NewCBCDecrypter(c, seg.iv).CryptBlocks(data, data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(data[len(data)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return fmt.Errorf("segment %d: bad padding, wrong key?", block.index)
+	}
+	block.Truncate(len(data) - pad)
+	return nil
+}
+
+// segmentKey 下载并缓存密钥, 失败时下次重试
+func (j *Job) segmentKey(ctx context.Context, k *segmentKey) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.key != nil {
+		return k.key, nil
+	}
+	req, err := j.newRequest(ctx, "GET", k.url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key %s: http status: %s", redactUrl(k.url), resp.Status)
+	}
+	key, err := io.ReadAll(io.LimitReader(resp.Body, aes.BlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("key %s: got %d bytes, want %d", redactUrl(k.url), len(key), aes.BlockSize)
+	}
+	k.key = key
+	return key, nil
+}
+
+// resolveRef 相对于播放列表解析地址
+func resolveRef(base *url.URL, ref string) (string, error) {
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -3,20 +3,66 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
-// GetDownloadsFolder return executable dir, fallback work dir
+// GetDownloadsFolder XDG_DOWNLOAD_DIR (环境变量或 user-dirs.dirs),
+// 其次 ~/Downloads (Linux 与 macOS, 不存在时由 checkDownloadsFolder 创建), 没有主目录时为工作目录
 func GetDownloadsFolder() string {
-	exePath, err := os.Executable()
-	if err != nil || strings.Contains(exePath, "go-build") {
-		wd, err := os.Getwd()
+	home, err := os.UserHomeDir()
+	if err != nil {
+		wd, _ := os.Getwd()
+		return wd
+	}
+	if dir := xdgUserDir("XDG_DOWNLOAD_DIR", home); dir != "" {
+		return dir
+	}
+	return filepath.Join(home, "Downloads")
+}
+
+// xdgUserDir 读取 xdg-user-dirs 的目录, 指向 $HOME 本身表示未启用
+func xdgUserDir(name, home string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		config := os.Getenv("XDG_CONFIG_HOME")
+		if config == "" {
+			config = filepath.Join(home, ".config")
+		}
+		f, err := os.Open(filepath.Join(config, "user-dirs.dirs"))
 		if err != nil {
-			return os.Getenv("HOME")
+			return ""
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if k, v, ok := strings.Cut(line, "="); ok && k == name {
+				value = strings.Trim(v, `"`)
+			}
 		}
-		return wd
 	}
-	return filepath.Dir(exePath)
+
+	for _, h := range []string{"$HOME", "${HOME}"} {
+		if rest, ok := strings.CutPrefix(value, h); ok && (rest == "" || rest[0] == '/') {
+			value = home + rest
+		}
+	}
+	if !filepath.IsAbs(value) { // 规范只允许 $HOME/ 开头或绝对路径
+		return ""
+	}
+	value = filepath.Clean(value)
+	if value == filepath.Clean(home) {
+		return ""
+	}
+	return value
+}
+
+// isCrossDevice 重命名失败是否因为跨文件系统
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
 }
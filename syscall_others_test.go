@@ -3,9 +3,36 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestGetDownloadsFolder(t *testing.T) {
-	t.Log(GetDownloadsFolder())
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_DOWNLOAD_DIR", "")
+	if got := GetDownloadsFolder(); got != filepath.Join(home, "Downloads") {
+		t.Fatalf("fallback: %s", got)
+	}
+
+	os.MkdirAll(filepath.Join(home, ".config"), 0755)
+	dirs := "# written by xdg-user-dirs-update\nXDG_DESKTOP_DIR=\"$HOME/Desktop\"\nXDG_DOWNLOAD_DIR=\"$HOME/下载\"\n"
+	os.WriteFile(filepath.Join(home, ".config", "user-dirs.dirs"), []byte(dirs), 0644)
+	if got := GetDownloadsFolder(); got != filepath.Join(home, "下载") {
+		t.Fatalf("user-dirs.dirs: %s", got)
+	}
+
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	os.WriteFile(filepath.Join(config, "user-dirs.dirs"), []byte("XDG_DOWNLOAD_DIR=\"$HOME/\"\n"), 0644)
+	if got := GetDownloadsFolder(); got != filepath.Join(home, "Downloads") {
+		t.Fatalf("disabled entry: %s", got)
+	}
+
+	t.Setenv("XDG_DOWNLOAD_DIR", "/srv/incoming")
+	if got := GetDownloadsFolder(); got != "/srv/incoming" {
+		t.Fatalf("environment: %s", got)
+	}
 }
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"syscall"
 	"unsafe"
@@ -18,6 +19,7 @@ var (
 
 var (
 	GlobalMemoryStatusExFunc = Kernel32Dll.NewProc("GlobalMemoryStatusEx")
+	GetDiskFreeSpaceExFunc   = Kernel32Dll.NewProc("GetDiskFreeSpaceExW")
 	SHGetKnownFolderPathFunc = shell32Dll.NewProc("SHGetKnownFolderPath")
 	CoTaskMemFreeFunc        = ole32Dll.NewProc("CoTaskMemFree")
 )
@@ -106,6 +108,30 @@ func SHGetKnownFolderPath(rfid *syscall.GUID, dwFlags uint32, hToken syscall.Han
 	return nil
 }
 
+// DiskFree 路径所在卷对当前用户可用的字节数
+func DiskFree(path string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	ret, _, err := GetDiskFreeSpaceExFunc.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return int64(avail), nil
+}
+
+// isDiskFull 写入失败是否因为磁盘已满
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.Errno(112)) || errors.Is(err, syscall.Errno(39)) // ERROR_DISK_FULL, ERROR_HANDLE_DISK_FULL
+}
+
+// isCrossDevice 重命名失败是否因为跨卷
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.Errno(17)) // ERROR_NOT_SAME_DEVICE
+}
+
 func CoTaskMemFree(pv uintptr) {
 	CoTaskMemFreeFunc.Call(pv)
 }
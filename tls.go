@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions 命令行 TLS 参数
+type TLSOptions struct {
+	CACert     string // PEM, 追加到系统根证书
+	ClientCert string // PEM, mTLS
+	ClientKey  string // PEM, 为空时从 ClientCert 读取
+	Insecure   bool   // 跳过证书校验
+	MinVersion string // 1.0, 1.1, 1.2, 1.3
+	Pins       string // sha256//base64;sha256//base64, 同 curl --pinnedpubkey
+}
+
+// tlsConfig Transport 共用, nil 为默认
+var tlsConfig *tls.Config
+
+var ErrPinMismatch = errors.New("public key does not match any pinned key")
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config 生成 tls.Config
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	c := &tls.Config{
+		InsecureSkipVerify: o.Insecure,
+	}
+
+	if o.MinVersion != "" {
+		v, ok := tlsVersions[o.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version: %s", o.MinVersion)
+		}
+		c.MinVersion = v
+	}
+
+	if o.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(o.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CACert)
+		}
+		c.RootCAs = pool
+	}
+
+	if o.ClientCert != "" {
+		key := o.ClientKey
+		if key == "" {
+			key = o.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	} else if o.ClientKey != "" {
+		return nil, errors.New("client key given without client certificate")
+	}
+
+	if o.Pins != "" {
+		pins, err := parsePins(o.Pins)
+		if err != nil {
+			return nil, err
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return c, nil
+}
+
+// parsePins 解析 sha256//base64, 分号分隔
+func parsePins(s string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(s, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		b64, ok := strings.CutPrefix(p, "sha256//")
+		if !ok {
+			return nil, fmt.Errorf("invalid pin %q, want sha256//base64", p)
+		}
+		pin, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifyPins 校验叶证书的 SPKI
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrPinMismatch
+	}
+	sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(pin, sum[:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: sha256//%s", ErrPinMismatch, base64.StdEncoding.EncodeToString(sum[:]))
+}
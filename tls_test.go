@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTLS 按参数重建 Client
+func useTLS(t *testing.T, o TLSOptions) error {
+	t.Helper()
+	c, err := o.Config()
+	if err != nil {
+		return err
+	}
+	old := tlsConfig
+	tlsConfig = c
+	Client = NewClient()
+	t.Cleanup(func() {
+		tlsConfig = old
+		Client = NewClient()
+	})
+	return nil
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func get(url string) error {
+	resp, err := Client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+func TestTLSOptions(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	spki := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256//" + base64.StdEncoding.EncodeToString(spki[:])
+	wrongPin := "sha256//" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	for _, c := range []struct {
+		name string
+		opts TLSOptions
+		ok   bool
+	}{
+		{"untrusted", TLSOptions{}, false},
+		{"ca-cert", TLSOptions{CACert: caFile}, true},
+		{"insecure", TLSOptions{Insecure: true}, true},
+		{"pin", TLSOptions{CACert: caFile, Pins: wrongPin + ";" + pin}, true},
+		{"wrong pin", TLSOptions{Insecure: true, Pins: wrongPin}, false},
+		{"tls-min 1.3", TLSOptions{CACert: caFile, MinVersion: "1.3"}, true},
+	} {
+		if err := useTLS(t, c.opts); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if err := get(srv.URL); (err == nil) != c.ok {
+			t.Errorf("%s: err = %v", c.name, err)
+		}
+	}
+
+	for _, o := range []TLSOptions{
+		{MinVersion: "1.4"},
+		{Pins: "md5//AAAA"},
+		{ClientKey: caFile},
+		{CACert: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := o.Config(); err == nil {
+			t.Errorf("%+v should fail", o)
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "godown"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	if err := useTLS(t, TLSOptions{Insecure: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(srv.URL); err == nil {
+		t.Fatal("request without client certificate should fail")
+	}
+
+	err = useTLS(t, TLSOptions{
+		Insecure:   true,
+		ClientCert: writePEM(t, "client.pem", "CERTIFICATE", der),
+		ClientKey:  writePEM(t, "client.key", "EC PRIVATE KEY", keyDer),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoPeers     = errors.New("no peer has the piece")
+	ErrPieceHash   = errors.New("piece hash mismatch")
+	ErrNoMetadata  = errors.New("no peer sent the torrent metadata")
+	followTorrent  = false // -follow-torrent, .torrent 地址下载其内容而非种子文件本身
+	maxTorrentPeer = 50    // 最多同时连接的 peer
+)
+
+const maxTorrentSize = 16 << 20
+
+// torrentInfo 种子的 info 字典
+type torrentInfo struct {
+	hash        [20]byte
+	name        string
+	pieceLength int
+	pieces      [][20]byte
+	length      int
+	files       []sourceFile // 多文件种子, 单文件为 nil
+}
+
+// metainfo .torrent 或 magnet 链接
+type metainfo struct {
+	hash     [20]byte
+	name     string
+	info     *torrentInfo // magnet 需要先从 peer 获取
+	trackers []string
+	webSeeds []string // BEP 19
+}
+
+// parseTorrentInfo 解析 info 字典原始字节
+func parseTorrentInfo(raw []byte) (*torrentInfo, error) {
+	v, err := bdecode(raw)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("torrent: info is not a dictionary")
+	}
+	d := bdict(m)
+	info := &torrentInfo{
+		hash:        sha1.Sum(raw),
+		name:        d.str("name"),
+		pieceLength: d.int("piece length"),
+	}
+	if info.name == "" || strings.ContainsAny(info.name, `/\`) || info.name == "." || info.name == ".." {
+		return nil, fmt.Errorf("torrent: bad name %q", info.name)
+	}
+	pieces := d.str("pieces")
+	if info.pieceLength <= 0 || len(pieces) == 0 || len(pieces)%20 != 0 {
+		return nil, errors.New("torrent: bad piece length or hashes")
+	}
+	info.pieces = make([][20]byte, len(pieces)/20)
+	for i := range info.pieces {
+		copy(info.pieces[i][:], pieces[i*20:])
+	}
+
+	if files := d.list("files"); files != nil {
+		for _, f := range files {
+			fm, _ := f.(map[string]any)
+			fd := bdict(fm)
+			var parts []string
+			for _, p := range fd.list("path") {
+				s, _ := p.(string)
+				parts = append(parts, s)
+			}
+			name := filepath.Join(parts...)
+			if len(parts) == 0 || !filepath.IsLocal(name) || strings.ContainsAny(strings.Join(parts, ""), `/\`) {
+				return nil, fmt.Errorf("torrent: bad file path %q", parts)
+			}
+			length := fd.int("length")
+			if length < 0 {
+				return nil, fmt.Errorf("torrent: bad length for %s", name)
+			}
+			info.files = append(info.files, sourceFile{path: name, offset: info.length, length: length})
+			info.length += length
+		}
+		if len(info.files) == 0 {
+			return nil, errors.New("torrent: empty file list")
+		}
+	} else {
+		info.length = d.int("length")
+	}
+	if want := (info.length + info.pieceLength - 1) / info.pieceLength; want != len(info.pieces) {
+		return nil, fmt.Errorf("torrent: %d pieces for %d bytes, want %d", len(info.pieces), info.length, want)
+	}
+	return info, nil
+}
+
+// parseTorrent 解析 .torrent
+func parseTorrent(data []byte) (*metainfo, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok || d.info == nil {
+		return nil, errors.New("torrent: missing info dictionary")
+	}
+	info, err := parseTorrentInfo(d.info)
+	if err != nil {
+		return nil, err
+	}
+	meta := &metainfo{hash: info.hash, name: info.name, info: info}
+
+	dict := bdict(m)
+	if s := dict.str("announce"); s != "" {
+		meta.trackers = append(meta.trackers, s)
+	}
+	for _, tier := range dict.list("announce-list") {
+		l, _ := tier.([]any)
+		for _, t := range l {
+			if s, _ := t.(string); s != "" && !slices.Contains(meta.trackers, s) {
+				meta.trackers = append(meta.trackers, s)
+			}
+		}
+	}
+	switch us := dict["url-list"].(type) {
+	case string:
+		meta.webSeeds = append(meta.webSeeds, us)
+	case []any:
+		for _, u := range us {
+			if s, _ := u.(string); s != "" {
+				meta.webSeeds = append(meta.webSeeds, s)
+			}
+		}
+	}
+	return meta, nil
+}
+
+// parseMagnet magnet:?xt=urn:btih:<hex|base32>&dn=&tr=&ws=
+func parseMagnet(s string) (*metainfo, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	meta := &metainfo{name: q.Get("dn"), trackers: q["tr"], webSeeds: q["ws"]}
+	var found bool
+	for _, xt := range q["xt"] {
+		h, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var b []byte
+		switch len(h) {
+		case 40:
+			b, err = hex.DecodeString(h)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(h))
+		default:
+			err = fmt.Errorf("bad info hash length %d", len(h))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("magnet: %w", err)
+		}
+		copy(meta.hash[:], b)
+		found = true
+	}
+	if !found {
+		return nil, errors.New("magnet: missing urn:btih")
+	}
+	return meta, nil
+}
+
+// torrentPeer peer 地址与连接状态
+type torrentPeer struct {
+	addr string
+	conn *peerConn // 未连接为 nil
+	busy bool      // 正在被某个块使用
+	dead bool      // 连接或校验失败, 不再使用
+}
+
+// TorrentSource 每个块对应一个 piece, 从 peer 或 web seed 下载并校验
+type TorrentSource struct {
+	meta   *metainfo
+	load   func(ctx context.Context) ([]byte, error) // 读取 .torrent, magnet 为 nil
+	peerID [20]byte
+
+	// httpGet 由 Job 提供, 复用代理, 头部与凭据; end 为 -1 时不带 Range
+	httpGet func(ctx context.Context, rawUrl string, start, end int) (*http.Response, error)
+	gotConn func()
+
+	mu           sync.Mutex
+	peers        []*torrentPeer
+	released     chan struct{} // peer 释放时关闭并替换, 唤醒等待者
+	lastAnnounce time.Time
+	nextSeed     int
+	closed       bool
+}
+
+func NewTorrentSource(meta *metainfo, load func(ctx context.Context) ([]byte, error)) *TorrentSource {
+	s := &TorrentSource{meta: meta, load: load, released: make(chan struct{})}
+	copy(s.peerID[:], "-GD0001-")
+	rand.Read(s.peerID[8:])
+	return s
+}
+
+func (s *TorrentSource) Stat(ctx context.Context) (info sourceInfo, err error) {
+	if s.meta == nil {
+		data, err := s.load(ctx)
+		if err != nil {
+			return info, err
+		}
+		if s.meta, err = parseTorrent(data); err != nil {
+			return info, err
+		}
+	}
+
+	s.announce(ctx)
+	if s.meta.info == nil {
+		if s.meta.info, err = s.fetchMetadata(ctx); err != nil {
+			return
+		}
+		s.meta.name = s.meta.info.name
+	}
+
+	ti := s.meta.info
+	log.Infof("Torrent %x: %d pieces of %s, %d peers, %d web seeds",
+		ti.hash, len(ti.pieces), FormatBytes(ti.pieceLength), len(s.peers), len(s.meta.webSeeds))
+	info.name = ti.name
+	info.size = ti.length
+	info.acceptRanges = true
+	info.blockSize = ti.pieceLength
+	info.files = ti.files
+	return
+}
+
+// announce 向所有 tracker 获取 peer, 失败的 tracker 只记录日志
+func (s *TorrentSource) announce(ctx context.Context) {
+	left := 0
+	if s.meta.info != nil {
+		left = s.meta.info.length
+	}
+	s.mu.Lock()
+	s.lastAnnounce = time.Now()
+	s.mu.Unlock()
+
+	for _, tr := range s.meta.trackers {
+		addrs, err := announce(ctx, tr, s.meta.hash, s.peerID, left, s.httpGet)
+		if err != nil {
+			log.Warnf("Tracker %s: %v", redactUrl(tr), err)
+			continue
+		}
+		log.Debugf("Tracker %s: %d peers", redactUrl(tr), len(addrs))
+		s.mu.Lock()
+		for _, a := range addrs {
+			known := false
+			for _, p := range s.peers {
+				known = known || p.addr == a
+			}
+			if !known {
+				s.peers = append(s.peers, &torrentPeer{addr: a})
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// fetchMetadata BEP 9, 逐个 peer 尝试获取 info 字典
+func (s *TorrentSource) fetchMetadata(ctx context.Context) (*torrentInfo, error) {
+	s.mu.Lock()
+	peers := append([]*torrentPeer(nil), s.peers...)
+	s.mu.Unlock()
+	for _, p := range peers {
+		c, err := dialPeer(ctx, p.addr, s.meta.hash, s.peerID, true)
+		if err != nil {
+			log.Debugf("Peer %s: %v", p.addr, err)
+			continue
+		}
+		if s.gotConn != nil {
+			s.gotConn()
+		}
+		raw, err := c.fetchMetadata(ctx)
+		c.Close()
+		if err == nil && sha1.Sum(raw) != s.meta.hash {
+			err = ErrPieceHash
+		}
+		if err != nil {
+			log.Debugf("Peer %s: metadata: %v", p.addr, err)
+			continue
+		}
+		return parseTorrentInfo(raw)
+	}
+	return nil, ErrNoMetadata
+}
+
+// acquire 取得一个拥有 piece 的空闲 peer, 没有时连接新 peer,
+// 都在忙时等待; 有 web seed 时不等待, 返回 ErrNoPeers 改用 web seed
+func (s *TorrentSource) acquire(ctx context.Context, piece int) (*torrentPeer, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return nil, context.Canceled
+		}
+		var candidate, busy *torrentPeer
+		connected := 0
+		for _, p := range s.peers {
+			if p.conn != nil {
+				connected++
+			}
+		}
+		for _, p := range s.peers {
+			switch {
+			case p.dead:
+			case p.busy:
+				if p.conn == nil || p.conn.has(piece) {
+					busy = p
+				}
+			case p.conn != nil && p.conn.has(piece):
+				p.busy = true
+				s.mu.Unlock()
+				return p, nil
+			case p.conn == nil && candidate == nil && connected < maxTorrentPeer:
+				candidate = p
+			}
+		}
+		if candidate != nil {
+			candidate.busy = true
+			s.mu.Unlock()
+			c, err := dialPeer(ctx, candidate.addr, s.meta.hash, s.peerID, false)
+			if err == nil && s.gotConn != nil {
+				s.gotConn()
+			}
+			s.mu.Lock()
+			candidate.conn = c
+			candidate.dead = err != nil
+			if err != nil {
+				log.Debugf("Peer %s: %v", candidate.addr, err)
+			}
+			s.releaseLocked(candidate)
+			s.mu.Unlock()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		wait := s.released
+		s.mu.Unlock()
+
+		if busy == nil || len(s.meta.webSeeds) > 0 {
+			return nil, ErrNoPeers
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *TorrentSource) releaseLocked(p *torrentPeer) {
+	p.busy = false
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// release 归还 peer, 出错时断开并不再使用
+func (s *TorrentSource) release(p *torrentPeer, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if (err != nil || s.closed) && p.conn != nil {
+		log.Debugf("Peer %s: %v", p.addr, err)
+		p.conn.Close()
+		p.conn, p.dead = nil, true
+	}
+	s.releaseLocked(p)
+}
+
+// pieceSize 最后一个 piece 可能较短
+func (s *TorrentSource) pieceSize(i int) int {
+	ti := s.meta.info
+	if i == len(ti.pieces)-1 {
+		return ti.length - i*ti.pieceLength
+	}
+	return ti.pieceLength
+}
+
+func (s *TorrentSource) OpenRange(ctx context.Context, start, end int) (io.ReadCloser, error) {
+	ti := s.meta.info
+	if end < 0 {
+		end = ti.length - 1
+	}
+	if start%ti.pieceLength != 0 || (end+1)%ti.pieceLength != 0 && end != ti.length-1 {
+		return nil, fmt.Errorf("torrent: range %d-%d is not aligned to pieces", start, end)
+	}
+	buf := &bytes.Buffer{}
+	for i := start / ti.pieceLength; i <= end/ti.pieceLength; i++ {
+		data, err := s.fetchPiece(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return io.NopCloser(buf), nil
+}
+
+// fetchPiece 依次尝试 peer, 没有可用 peer 时使用 web seed
+func (s *TorrentSource) fetchPiece(ctx context.Context, i int) ([]byte, error) {
+	for {
+		p, err := s.acquire(ctx, i)
+		if err == ErrNoPeers {
+			if len(s.meta.webSeeds) > 0 {
+				return s.webSeedPiece(ctx, i)
+			}
+			s.mu.Lock()
+			stale := time.Since(s.lastAnnounce) > time.Second*10
+			s.mu.Unlock()
+			if stale && s.meta.trackers != nil {
+				s.announce(ctx)
+				continue
+			}
+			return nil, fmt.Errorf("piece %d: %w", i, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := p.conn.downloadPiece(ctx, i, s.pieceSize(i))
+		if err == nil && sha1.Sum(data) != s.meta.info.pieces[i] {
+			err = ErrPieceHash
+		}
+		s.release(p, err)
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// webSeedPiece BEP 19, piece 跨文件时分别请求
+func (s *TorrentSource) webSeedPiece(ctx context.Context, i int) ([]byte, error) {
+	ti := s.meta.info
+	s.mu.Lock()
+	seed := s.meta.webSeeds[s.nextSeed%len(s.meta.webSeeds)]
+	s.nextSeed++
+	s.mu.Unlock()
+
+	files := ti.files
+	if files == nil {
+		files = []sourceFile{{path: ti.name, length: ti.length}}
+	}
+	start := i * ti.pieceLength
+	end := start + s.pieceSize(i) // 右开
+	buf := bytes.NewBuffer(make([]byte, 0, end-start))
+	for _, f := range files {
+		from, to := max(start, f.offset), min(end, f.offset+f.length)
+		if from >= to {
+			continue
+		}
+		u := seed
+		switch {
+		case ti.files != nil:
+			parts := append([]string{ti.name}, strings.Split(filepath.ToSlash(f.path), "/")...)
+			for k, p := range parts {
+				parts[k] = url.PathEscape(p)
+			}
+			u = strings.TrimSuffix(seed, "/") + "/" + path.Join(parts...)
+		case strings.HasSuffix(seed, "/"):
+			u = seed + url.PathEscape(ti.name)
+		}
+		resp, err := s.httpGet(ctx, u, from-f.offset, to-f.offset-1)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("web seed %s: http status: %s", redactUrl(u), resp.Status)
+		}
+		_, err = io.CopyN(buf, resp.Body, int64(to-from))
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("web seed %s: %w", redactUrl(u), err)
+		}
+	}
+	if sha1.Sum(buf.Bytes()) != ti.pieces[i] {
+		return nil, fmt.Errorf("web seed %s: piece %d: %w", redactUrl(seed), i, ErrPieceHash)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *TorrentSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, p := range s.peers {
+		if p.conn != nil && !p.busy {
+			p.conn.Close()
+			p.conn = nil
+		}
+	}
+	return nil
+}
+
+// initTorrent 代替 fetchHeader, magnet 时 load 为 nil
+func (j *Job) initTorrent(meta *metainfo, load func(ctx context.Context) ([]byte, error)) error {
+	j.src = SRC_TORRENT
+	s := NewTorrentSource(meta, load)
+	s.httpGet = j.torrentGet
+	s.gotConn = func() { j.conns.Add(1) }
+	j.source = s
+	j.proto = "BitTorrent"
+	return j.statSource()
+}
+
+// loadTorrent 读取 .torrent, 无 scheme 时为本地文件
+func (j *Job) loadTorrent(ctx context.Context) ([]byte, error) {
+	u, err := url.Parse(j.Url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Scheme == "file" {
+		return os.ReadFile(u.Path)
+	}
+	resp, err := j.torrentGet(withRedirectLog(ctx, &j.redirects), j.Url, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("torrent %s: http status: %s", redactUrl(j.Url), resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxTorrentSize))
+}
+
+// torrentGet tracker, web seed 与 .torrent 的 HTTP 请求
+func (j *Job) torrentGet(ctx context.Context, rawUrl string, start, end int) (*http.Response, error) {
+	req, err := j.newRequest(ctx, "GET", rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if end >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+	return j.do(req)
+}
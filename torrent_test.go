@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testTorrent 由文件列表生成 info 字典, 单个文件时为单文件种子
+type testTorrent struct {
+	info  []byte
+	hash  [20]byte
+	data  []byte // 所有文件首尾相连
+	files map[string][]byte
+}
+
+func newTestTorrent(name string, pieceLen int, files map[string][]byte, order []string) *testTorrent {
+	tt := &testTorrent{files: files}
+	info := map[string]any{"name": name, "piece length": pieceLen}
+	if order == nil {
+		tt.data = files[name]
+		info["length"] = len(tt.data)
+	} else {
+		var list []any
+		for _, p := range order {
+			tt.data = append(tt.data, files[p]...)
+			var parts []any
+			for _, s := range strings.Split(p, "/") {
+				parts = append(parts, s)
+			}
+			list = append(list, map[string]any{"length": len(files[p]), "path": parts})
+		}
+		info["files"] = list
+	}
+	var pieces []byte
+	for off := 0; off < len(tt.data); off += pieceLen {
+		sum := sha1.Sum(tt.data[off:min(off+pieceLen, len(tt.data))])
+		pieces = append(pieces, sum[:]...)
+	}
+	info["pieces"] = pieces
+	tt.info = bencode(info)
+	tt.hash = sha1.Sum(tt.info)
+	return tt
+}
+
+func (tt *testTorrent) file(trackers []string, webSeeds []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("d")
+	if len(trackers) > 0 {
+		b.Write(bencode("announce"))
+		b.Write(bencode(trackers[0]))
+	}
+	b.Write(bencode("info"))
+	b.Write(tt.info)
+	if len(webSeeds) > 0 {
+		var l []any
+		for _, s := range webSeeds {
+			l = append(l, s)
+		}
+		b.Write(bencode("url-list"))
+		b.Write(bencode(l))
+	}
+	b.WriteString("e")
+	return b.Bytes()
+}
+
+// testSeeder 拥有全部 piece 的 peer, corrupt 时发送错误数据
+type testSeeder struct {
+	tt       *testTorrent
+	pieceLen int
+	corrupt  bool
+	ln       net.Listener
+	requests atomic.Int32
+}
+
+func newTestSeeder(t *testing.T, tt *testTorrent, pieceLen int, corrupt bool) *testSeeder {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSeeder{tt: tt, pieceLen: pieceLen, corrupt: corrupt, ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testSeeder) addr() string { return s.ln.Addr().String() }
+
+func (s *testSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	hs := make([]byte, 68)
+	if _, err := io.ReadFull(r, hs); err != nil || !bytes.Equal(hs[28:48], s.tt.hash[:]) {
+		return
+	}
+	copy(hs[48:], "-TS0001-000000000000")
+	conn.Write(hs)
+
+	send := func(id byte, payload []byte) {
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+		conn.Write(append(append(b, id), payload...))
+	}
+	n := (len(s.tt.data) + s.pieceLen - 1) / s.pieceLen
+	bitfield := make([]byte, (n+7)/8)
+	for i := 0; i < n; i++ {
+		bitfield[i/8] |= 0x80 >> (i % 8)
+	}
+	send(msgBitfield, bitfield)
+
+	clientMeta := 0
+	for {
+		var l [4]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(l[:]))
+		if _, err := io.ReadFull(r, msg); err != nil || len(msg) == 0 {
+			return
+		}
+		switch payload := msg[1:]; msg[0] {
+		case msgInterested:
+			send(msgUnchoke, nil)
+		case msgRequest:
+			s.requests.Add(1)
+			index := int(binary.BigEndian.Uint32(payload))
+			begin := int(binary.BigEndian.Uint32(payload[4:]))
+			length := int(binary.BigEndian.Uint32(payload[8:]))
+			off := index*s.pieceLen + begin
+			block := bytes.Clone(s.tt.data[off : off+length])
+			if s.corrupt {
+				block[0] ^= 0xff
+			}
+			send(msgPiece, append(payload[:8:8], block...))
+		case msgExtended:
+			v, _, _ := bdecodePrefix(payload[1:])
+			m, _ := v.(map[string]any)
+			d := bdict(m)
+			if payload[0] == 0 { // 扩展握手
+				clientMeta = d.dict("m").int("ut_metadata")
+				send(msgExtended, append([]byte{0}, bencode(map[string]any{
+					"m":             map[string]any{"ut_metadata": 3},
+					"metadata_size": len(s.tt.info),
+				})...))
+				continue
+			}
+			piece := d.int("piece")
+			start := piece * peerBlockLen
+			resp := append([]byte{byte(clientMeta)}, bencode(map[string]any{
+				"msg_type": 1, "piece": piece, "total_size": len(s.tt.info),
+			})...)
+			send(msgExtended, append(resp, s.tt.info[start:min(start+peerBlockLen, len(s.tt.info))]...))
+		}
+	}
+}
+
+func compactAddr(addr string) []byte {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	return binary.BigEndian.AppendUint16(net.ParseIP(host).To4(), uint16(p))
+}
+
+// newUDPTracker BEP 15, 每次 announce 返回 peers
+func newUDPTracker(t *testing.T, hash [20]byte, peers ...string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			resp := make([]byte, 8, 64)
+			copy(resp[4:], req[12:16])
+			switch {
+			case n == 16 && binary.BigEndian.Uint64(req) == udpTrackerMagic:
+				resp = append(resp, "connid42"...)
+			case n == 98 && string(req[:8]) == "connid42" && bytes.Equal(req[16:36], hash[:]):
+				binary.BigEndian.PutUint32(resp, 1)
+				resp = append(resp, make([]byte, 12)...)
+				for _, p := range peers {
+					resp = append(resp, compactAddr(p)...)
+				}
+			default:
+				continue
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String() + "/announce"
+}
+
+func TestParseMagnet(t *testing.T) {
+	hash := sha1.Sum([]byte("info"))
+	for _, xt := range []string{fmt.Sprintf("%x", hash), base32.StdEncoding.EncodeToString(hash[:])} {
+		m, err := parseMagnet("magnet:?xt=urn:btih:" + xt + "&dn=a.iso&tr=udp%3A%2F%2Ft%3A80&tr=http%3A%2F%2Ft%2Fa&ws=http%3A%2F%2Fw%2F")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.hash != hash || m.name != "a.iso" || len(m.trackers) != 2 || len(m.webSeeds) != 1 || m.info != nil {
+			t.Fatalf("%+v", m)
+		}
+	}
+	if _, err := parseMagnet("magnet:?dn=x"); err == nil {
+		t.Fatal("missing xt should fail")
+	}
+}
+
+func TestParseTorrentRejectsUnsafePath(t *testing.T) {
+	info := bencode(map[string]any{
+		"name": "x", "piece length": 16, "pieces": make([]byte, 20),
+		"files": []any{map[string]any{"length": 1, "path": []any{"..", "etc"}}},
+	})
+	if _, err := parseTorrentInfo(info); err == nil {
+		t.Fatal("path traversal should be rejected")
+	}
+}
+
+func TestTorrentDownload(t *testing.T) {
+	setupDownload(t, 0, 4)
+
+	const pieceLen = 32 << 10
+	tt := newTestTorrent("a.bin", pieceLen, map[string][]byte{"a.bin": randomData(pieceLen*5 + 1234)}, nil)
+	bad := newTestSeeder(t, tt, pieceLen, true)
+	good := newTestSeeder(t, tt, pieceLen, false)
+
+	var announces atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/announce":
+			if r.URL.Query().Get("info_hash") != string(tt.hash[:]) {
+				w.Write(bencode(map[string]any{"failure reason": "unknown torrent"}))
+				return
+			}
+			announces.Add(1)
+			peers := append(compactAddr(bad.addr()), compactAddr(good.addr())...)
+			w.Write(bencode(map[string]any{"interval": 1800, "peers": peers}))
+		case "/a.torrent":
+			w.Write(tt.file([]string{"http://" + r.Host + "/announce"}, nil))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	// 默认下载种子文件本身
+	j := &Job{Url: srv.URL + "/a.torrent"}
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(j.filePath); j.src == SRC_TORRENT || !bytes.Equal(got, tt.file([]string{srv.URL + "/announce"}, nil)) {
+		t.Fatalf("src: %d, want the .torrent file itself", j.src)
+	}
+
+	defer func(f bool) { followTorrent = f }(followTorrent)
+	followTorrent = true
+	j = &Job{Url: srv.URL + "/a.torrent"}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, tt.data) {
+		t.Fatal("content mismatch")
+	}
+	if j.src != SRC_TORRENT || len(j.Blocks) != 6 || announces.Load() == 0 {
+		t.Fatalf("src: %d, blocks: %d, announces: %d", j.src, len(j.Blocks), announces.Load())
+	}
+	if good.requests.Load() == 0 {
+		t.Fatal("good seeder was not used")
+	}
+}
+
+func TestMagnetMultiFile(t *testing.T) {
+	setupDownload(t, 0, 3)
+
+	const pieceLen = 16 << 10
+	files := map[string][]byte{
+		"docs/readme.txt": []byte("hello torrent"),
+		"video/a.mp4":     randomData(pieceLen*3 + 77),
+		"video/b.mp4":     randomData(pieceLen + 5),
+	}
+	tt := newTestTorrent("pack", pieceLen, files, []string{"docs/readme.txt", "video/a.mp4", "video/b.mp4"})
+	seeder := newTestSeeder(t, tt, pieceLen, false)
+	tracker := newUDPTracker(t, tt.hash, seeder.addr())
+
+	j := &Job{Url: fmt.Sprintf("magnet:?xt=urn:btih:%x&tr=%s", tt.hash, url.QueryEscape(tracker))}
+	j.Start()
+
+	for p, data := range files {
+		got, err := os.ReadFile(filepath.Join(DownloadsFolder, "pack", p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: content mismatch", p)
+		}
+	}
+	entries, _ := os.ReadDir(DownloadsFolder)
+	if len(entries) != 1 {
+		t.Fatalf("part file should be removed: %v", entries)
+	}
+}
+
+func TestTorrentWebSeed(t *testing.T) {
+	setupDownload(t, 0, 4)
+
+	const pieceLen = 16 << 10
+	tt := newTestTorrent("w.bin", pieceLen, map[string][]byte{"w.bin": randomData(pieceLen*4 + 10)}, nil)
+	var ranges atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/seed/w.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(tt.data))
+	}))
+	defer srv.Close()
+
+	// 本地 .torrent, 只有 web seed
+	p := filepath.Join(t.TempDir(), "w.torrent")
+	if err := os.WriteFile(p, tt.file(nil, []string{srv.URL + "/seed/"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := &Job{Url: p}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "w.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, tt.data) {
+		t.Fatal("content mismatch")
+	}
+	if ranges.Load() != 5 {
+		t.Fatalf("range requests: %d, want one per piece", ranges.Load())
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	trackerPort     = 6881 // 只下载不做种, 仅用于填写 announce
+	udpTrackerMagic = 0x41727101980
+)
+
+// announce 向 tracker 报告开始下载并获取 peer 地址, 支持 http(s) 与 udp (BEP 15)
+func announce(ctx context.Context, tracker string, hash, peerID [20]byte, left int,
+	httpGet func(ctx context.Context, rawUrl string, start, end int) (*http.Response, error)) ([]string, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, u, hash, peerID, left, httpGet)
+	case "udp":
+		return announceUDP(ctx, u.Host, hash, peerID, left)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+}
+
+func announceHTTP(ctx context.Context, u *url.URL, hash, peerID [20]byte, left int,
+	httpGet func(ctx context.Context, rawUrl string, start, end int) (*http.Response, error)) ([]string, error) {
+	q := fmt.Sprintf("info_hash=%s&peer_id=%s&port=%d&uploaded=0&downloaded=0&left=%d&compact=1&numwant=50&event=started",
+		url.QueryEscape(string(hash[:])), url.QueryEscape(string(peerID[:])), trackerPort, left)
+	if u.RawQuery != "" {
+		q = u.RawQuery + "&" + q
+	}
+	uu := *u
+	uu.RawQuery = q
+
+	resp, err := httpGet(ctx, uu.String(), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	v, err := bdecode(body)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]any)
+	d := bdict(m)
+	if reason := d.str("failure reason"); reason != "" {
+		return nil, errors.New(reason)
+	}
+
+	var peers []string
+	switch p := d["peers"].(type) {
+	case string:
+		peers = compactPeers([]byte(p), net.IPv4len)
+	case []any:
+		for _, e := range p {
+			pm, _ := e.(map[string]any)
+			pd := bdict(pm)
+			if ip, port := pd.str("ip"), pd.int("port"); ip != "" && port > 0 {
+				peers = append(peers, net.JoinHostPort(ip, strconv.Itoa(port)))
+			}
+		}
+	}
+	peers = append(peers, compactPeers([]byte(d.str("peers6")), net.IPv6len)...)
+	return peers, nil
+}
+
+// compactPeers 每项为 IP 加 2 字节端口
+func compactPeers(b []byte, ipLen int) []string {
+	var peers []string
+	for ; len(b) >= ipLen+2; b = b[ipLen+2:] {
+		ip := net.IP(b[:ipLen])
+		port := binary.BigEndian.Uint16(b[ipLen:])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peers
+}
+
+func announceUDP(ctx context.Context, host string, hash, peerID [20]byte, left int) ([]string, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// roundTrip 发送请求, 读取 action 与事务号匹配的响应
+	roundTrip := func(req []byte, action uint32) ([]byte, error) {
+		txID := binary.BigEndian.Uint32(req[12:16])
+		for attempt := 0; attempt < 3; attempt++ {
+			if _, err := conn.Write(req); err != nil {
+				return nil, err
+			}
+			buf := make([]byte, 2048)
+			conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					var ne net.Error
+					if errors.As(err, &ne) && ne.Timeout() {
+						break // 重发
+					}
+					return nil, err
+				}
+				resp := buf[:n]
+				if n < 8 || binary.BigEndian.Uint32(resp[4:8]) != txID {
+					continue
+				}
+				switch binary.BigEndian.Uint32(resp[:4]) {
+				case action:
+					return resp, nil
+				case 3: // error
+					return nil, errors.New(string(resp[8:]))
+				}
+			}
+		}
+		return nil, errors.New("udp tracker timeout")
+	}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req, udpTrackerMagic)
+	binary.BigEndian.PutUint32(req[8:], 0) // connect
+	rand.Read(req[12:16])
+	resp, err := roundTrip(req, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 16 {
+		return nil, errors.New("short udp connect response")
+	}
+	connID := resp[8:16]
+
+	req = make([]byte, 98)
+	copy(req, connID)
+	binary.BigEndian.PutUint32(req[8:], 1) // announce
+	rand.Read(req[12:16])
+	copy(req[16:], hash[:])
+	copy(req[36:], peerID[:])
+	binary.BigEndian.PutUint64(req[64:], uint64(left))
+	binary.BigEndian.PutUint32(req[80:], 2) // started
+	rand.Read(req[88:92])                   // key
+	binary.BigEndian.PutUint32(req[92:], ^uint32(0))
+	binary.BigEndian.PutUint16(req[96:], trackerPort)
+	if resp, err = roundTrip(req, 1); err != nil {
+		return nil, err
+	}
+	if len(resp) < 20 {
+		return nil, errors.New("short udp announce response")
+	}
+	ipLen := net.IPv4len
+	if strings.HasPrefix(host, "[") { // IPv6 tracker 返回 IPv6 peer
+		ipLen = net.IPv6len
+	}
+	return compactPeers(resp[20:], ipLen), nil
+}
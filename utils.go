@@ -5,12 +5,16 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+
+	log "github.com/sirupsen/logrus"
 )
 
 func FormatBytes(bytes int) string {
@@ -58,7 +62,80 @@ func GetUniqueFilePath(path string) string {
 	return uniquePath
 }
 
+// moveFile 重命名, 跨文件系统时退化为复制
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !isCrossDevice(err) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+var minFreeSpace zeroSizeFlag // -min-free, 下载目录至少需要的可用空间, 0 为不检查
+
+// checkDownloadsFolder 确认下载目录存在 (不存在时创建)、可写, 设置了 minFreeSpace 时检查剩余空间
+func checkDownloadsFolder(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".godown-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if minFreeSpace == 0 {
+		return nil
+	}
+
+	free, err := DiskFree(dir)
+	if err != nil {
+		log.Debugf("Failed to get free space of %s: %v", dir, err)
+		return nil
+	}
+	if free < int64(minFreeSpace) {
+		return fmt.Errorf("%s has only %s free", dir, FormatBytes(int(free)))
+	}
+	return nil
+}
+
+// redactUrl 隐藏 URL 中的密码
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return u.Redacted()
+}
+
 func Hyperlink(link string) string {
+	if plainOutput {
+		return link
+	}
 	return fmt.Sprintf("\x1b]8;;file://%s\x1b\\%s\x1b]8;;\x1b\\", link, link)
 }
 
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getetag/><d:getlastmodified/></d:prop></d:propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				Collection    *struct{} `xml:"DAV: resourcetype>collection"`
+				ContentLength string    `xml:"DAV: getcontentlength"`
+				ETag          string    `xml:"DAV: getetag"`
+				LastModified  string    `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// davEntry PROPFIND 返回的一项
+type davEntry struct {
+	url     *url.URL
+	dir     bool
+	size    int // 未知时为 -1
+	etag    string
+	modTime time.Time
+}
+
+// davHttpUrl dav:// 与 davs:// 换成 http(s), URL 中的凭据转为 Auth
+func davHttpUrl(u *url.URL) (string, *Auth) {
+	hu := *u
+	switch u.Scheme {
+	case "dav":
+		hu.Scheme = "http"
+	case "davs":
+		hu.Scheme = "https"
+	}
+	var auth *Auth
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth = &Auth{Host: u.Host, User: u.User.Username(), Password: pass}
+		hu.User = nil
+	}
+	return hu.String(), auth
+}
+
+// propfind depth 为 "0" 时只返回自身, "1" 时包括直接子项
+func (j *Job) propfind(ctx context.Context, rawUrl, depth string) ([]davEntry, error) {
+	req, err := j.newRequest(ctx, "PROPFIND", rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(strings.NewReader(propfindBody))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(propfindBody)), nil }
+	req.ContentLength = int64(len(propfindBody))
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", depth)
+
+	resp, err := j.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s: http status: %s", redactUrl(rawUrl), resp.Status)
+	}
+	j.proto = resp.Proto
+
+	var ms davMultistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND %s: %w", redactUrl(rawUrl), err)
+	}
+	var entries []davEntry
+	for _, r := range ms.Responses {
+		href, err := resp.Request.URL.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		e := davEntry{url: href, size: -1}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			p := ps.Prop
+			e.dir = e.dir || p.Collection != nil
+			if n, err := strconv.Atoi(strings.TrimSpace(p.ContentLength)); err == nil {
+				e.size = n
+			}
+			if p.ETag != "" {
+				e.etag = p.ETag
+			}
+			if t, err := http.ParseTime(p.LastModified); err == nil {
+				e.modTime = t
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// initDAV 代替 fetchHeader, 大小与 ETag 来自 PROPFIND, 之后按 HTTP 分块下载
+func (j *Job) initDAV(u *url.URL) error {
+	var auth *Auth
+	j.Url, auth = davHttpUrl(u)
+	if j.Auth == nil {
+		j.Auth = auth
+	}
+	ctx, cancel := context.WithTimeout(j.ctx, time.Second*30)
+	defer cancel()
+
+	entries, err := j.propfind(withRedirectLog(ctx, &j.redirects), j.Url, "0")
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("PROPFIND %s: empty response", redactUrl(j.Url))
+	}
+	e := entries[0]
+	if e.dir {
+		return fmt.Errorf("%s is a collection", redactUrl(j.Url))
+	}
+	j.setFinalUrl(e.url.String())
+	j.fileName = path.Base(e.url.Path)
+	j.size = e.size
+	j.etag = e.etag
+	j.lastModified = e.modTime
+	j.acceptRanges = true
+	return j.checkSize()
+}
+
+// isWebDAV dav(s):// 或以 / 结尾且 OPTIONS 返回 DAV 头的 http(s) 地址
+func isWebDAV(ctx context.Context, rawUrl string, header http.Header, auth *Auth) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "dav", "davs":
+		return true
+	case "http", "https":
+		if !strings.HasSuffix(u.Path, "/") {
+			return false
+		}
+	default:
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	j := &Job{Header: header, Auth: auth}
+	req, err := j.newRequest(ctx, "OPTIONS", rawUrl)
+	if err != nil {
+		return false
+	}
+	resp, err := j.do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 300 && strings.Contains(resp.Header.Get("DAV"), "1")
+}
+
+// listWebDAV 逐层 PROPFIND Depth: 1 列出集合下的文件, 返回 dav(s):// 地址与相对子目录;
+// 地址本身是文件时只返回它
+func listWebDAV(ctx context.Context, rawUrl string, header http.Header, auth *Auth) (urls, dirs []string, err error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, urlAuth := davHttpUrl(u)
+	if auth == nil {
+		auth = urlAuth
+	}
+	j := &Job{Header: header, Auth: auth}
+	davScheme := map[string]string{"http": "dav", "https": "davs"}
+
+	var rootPath string
+	queue := []string{root}
+	seen := map[string]bool{}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		entries, err := j.propfind(ctx, cur, "1")
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, e := range entries {
+			if rootPath == "" && i == 0 { // 第一项为请求的地址本身
+				if !e.dir {
+					return []string{rawUrl}, []string{""}, nil
+				}
+				rootPath = strings.TrimSuffix(e.url.Path, "/") + "/"
+			}
+			p := strings.TrimSuffix(e.url.Path, "/")
+			if seen[p] || p+"/" == rootPath {
+				seen[p] = true
+				continue
+			}
+			seen[p] = true
+			rel, ok := strings.CutPrefix(p, rootPath)
+			if !ok || !filepath.IsLocal(filepath.FromSlash(rel)) {
+				log.Warnf("Skipping %s outside of %s", e.url.Path, rootPath)
+				continue
+			}
+			if e.dir {
+				queue = append(queue, e.url.String())
+				continue
+			}
+			fu := *e.url
+			fu.Scheme = davScheme[fu.Scheme]
+			fu.User = u.User
+			dir := path.Dir(rel)
+			if dir == "." {
+				dir = ""
+			}
+			urls = append(urls, fu.String())
+			dirs = append(dirs, filepath.FromSlash(dir))
+		}
+	}
+	return urls, dirs, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// newDavServer 内存中的 WebDAV 服务, 要求 Basic 认证
+func newDavServer(t *testing.T, files map[string][]byte) (*httptest.Server, *atomic.Int32) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	for p, data := range files {
+		parts := strings.Split(strings.Trim(path.Dir(p), "/"), "/")
+		for i := range parts { // 逐级创建目录
+			fs.Mkdir(ctx, "/"+strings.Join(parts[:i+1], "/"), 0755)
+		}
+		f, err := fs.OpenFile(ctx, p, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+		f.Close()
+	}
+	h := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	var ranges atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "alice" || p != "s3cret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dav"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &ranges
+}
+
+func TestWebDAVDownload(t *testing.T) {
+	setupDownload(t, 32*1024, 4)
+
+	data := randomData(blockSize*4 + 17)
+	srv, ranges := newDavServer(t, map[string][]byte{"/remote.php/dav/files/a b.bin": data})
+
+	j := &Job{Url: "dav://alice:s3cret@" + strings.TrimPrefix(srv.URL, "http://") + "/remote.php/dav/files/a%20b.bin"}
+	j.Start()
+
+	got, err := os.ReadFile(filepath.Join(DownloadsFolder, "a b.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+	if j.src != SRC_WEBDAV || j.etag == "" || ranges.Load() != 5 {
+		t.Fatalf("src: %d, etag: %q, ranged: %d", j.src, j.etag, ranges.Load())
+	}
+}
+
+func TestWebDAVMirror(t *testing.T) {
+	setupDownload(t, 0, 0)
+
+	files := map[string][]byte{
+		"/share/readme.txt":        []byte("hello"),
+		"/share/photos/a.jpg":      randomData(3000),
+		"/share/photos/2024/b.jpg": randomData(4000),
+		"/other/secret.txt":        []byte("no"),
+	}
+	srv, _ := newDavServer(t, files)
+	auth := &Auth{Host: strings.TrimPrefix(srv.URL, "http://"), User: "alice", Password: "s3cret"}
+
+	root := srv.URL + "/share/"
+	if !isWebDAV(context.Background(), root, nil, auth) {
+		t.Fatal("http collection should be detected as WebDAV")
+	}
+	if isWebDAV(context.Background(), srv.URL+"/share/readme.txt", nil, auth) {
+		t.Fatal("file URL should not be detected")
+	}
+	urls, dirs, err := listWebDAV(context.Background(), root, nil, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 3 {
+		t.Fatalf("urls: %v", urls)
+	}
+	for i, u := range urls {
+		if !strings.HasPrefix(u, "dav://") {
+			t.Fatalf("url: %s", u)
+		}
+		(&Job{Url: u, Auth: auth, SubDir: dirs[i]}).Start()
+	}
+	for p, data := range files {
+		rel, ok := strings.CutPrefix(p, "/share/")
+		if !ok {
+			continue
+		}
+		got, err := os.ReadFile(filepath.Join(DownloadsFolder, filepath.FromSlash(rel)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: %v", rel, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(DownloadsFolder, "secret.txt")); !os.IsNotExist(err) {
+		t.Fatal("files outside the collection should not be mirrored")
+	}
+}
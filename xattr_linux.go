@@ -0,0 +1,12 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// SetXattr 写入扩展属性
+func SetXattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetXattr(t *testing.T) {
+	setupDownload(t, 0, 0)
+	writeXattrs = true
+	defer func() { writeXattrs = false }()
+
+	probe := filepath.Join(DownloadsFolder, "probe")
+	os.WriteFile(probe, nil, 0644)
+	if err := SetXattr(probe, "user.test", "1"); errors.Is(err, syscall.ENOTSUP) {
+		t.Skip("filesystem does not support user xattrs")
+	}
+
+	srv := newTestServer(t, "hello.txt", []byte("hello"), time.Now())
+	j := &Job{Url: srv.URL + "/hello.txt"}
+	j.Start()
+
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(j.filePath, "user.xdg.origin.url", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != j.Url {
+		t.Fatalf("user.xdg.origin.url: %s", buf[:n])
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// SetXattr 写入扩展属性, 仅支持 Linux
+func SetXattr(path, name, value string) error {
+	return errors.New("extended attributes are not supported on this platform")
+}